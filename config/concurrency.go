@@ -0,0 +1,81 @@
+package config
+
+import (
+	"context"
+	"time"
+
+	"github.com/aw16com/tollbooth/store"
+)
+
+// AcquireInFlight takes an in-flight slot of the bucket identified by key, limited by the MaxInFlight
+// of rule or of the limiter. It returns the function releasing the slot, to call once the request is
+// handled, or the rejection when every slot is held. FailurePolicy applies when the semaphore fails.
+func (l *Limiter) AcquireInFlight(key string, rule *RateLimit) (func(), *Result) {
+	return l.AcquireInFlightContext(context.Background(), key, rule)
+}
+
+// AcquireInFlightContext is AcquireInFlight calling the semaphore with ctx.
+// The slot is released even if ctx is done by then.
+func (l *Limiter) AcquireInFlightContext(ctx context.Context, key string, rule *RateLimit) (func(), *Result) {
+	max := l.MaxInFlight
+	if rule != nil && rule.MaxInFlight > 0 {
+		max = rule.MaxInFlight
+	}
+	if max <= 0 || l.Semaphore == nil {
+		return func() {}, nil
+	}
+
+	semaphoreKey := key + ":inflight"
+	var lease store.Lease
+	err := l.call(ctx, "acquire", semaphoreKey, func(ctx context.Context) (err error) {
+		lease, err = l.Semaphore.Acquire(ctx, semaphoreKey, max, l.InFlightTTL)
+		return err
+	})
+	if err != nil {
+		switch l.FailurePolicy {
+		case FailClosed:
+			rejected := inFlightRejection(key, max, rule, 0)
+			rejected.RetryAfter, rejected.ResetAt, rejected.Err = l.BreakerCooldown, time.Now().Add(l.BreakerCooldown), err
+			return nil, l.decide(rejected)
+		case FailLocal:
+			_, local := l.local()
+			lease, _ = local.Acquire(ctx, semaphoreKey, max, l.InFlightTTL)
+			if !lease.Acquired {
+				rejected := inFlightRejection(key, max, rule, lease.InFlight)
+				rejected.Err = err
+				return nil, l.decide(rejected)
+			}
+			return func() { local.Release(context.Background(), lease) }, nil
+		default:
+			return func() {}, nil
+		}
+	}
+
+	if !lease.Acquired {
+		return nil, l.decide(inFlightRejection(key, max, rule, lease.InFlight))
+	}
+
+	return func() { l.release(lease) }, nil
+}
+
+// inFlightRejection returns the rejection of a request of key because inFlight requests hold the max slots.
+// When a slot is freed is unknown, clients are asked to retry after a second.
+func inFlightRejection(key string, max int64, rule *RateLimit, inFlight int64) *Result {
+	return &Result{
+		Key:              key,
+		Limit:            LimitValue{Max: max},
+		Rule:             rule,
+		InFlight:         inFlight,
+		InFlightRejected: true,
+		ResetAt:          time.Now().Add(time.Second),
+		RetryAfter:       time.Second,
+	}
+}
+
+// release frees the slot held by lease. The release is not bounded by the context of the request,
+// which may be done by then.
+func (l *Limiter) release(lease store.Lease) {
+	l.call(context.Background(), "release", lease.Key, func(ctx context.Context) error {
+		return l.Semaphore.Release(ctx, lease)
+	})
+}
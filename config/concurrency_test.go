@@ -0,0 +1,45 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireInFlight(t *testing.T) {
+	limiter := NewLimiter(10, time.Second, nil)
+	defer limiter.Close()
+	limiter.MaxInFlight = 2
+	key := "TestAcquireInFlight"
+
+	first, rejected := limiter.AcquireInFlight(key, nil)
+	if rejected != nil {
+		t.Fatalf("First request should acquire a slot. Result: %+v", rejected)
+	}
+	limiter.AcquireInFlight(key, nil)
+
+	_, rejected = limiter.AcquireInFlight(key, nil)
+	if rejected == nil || rejected.Allowed || rejected.InFlight != 2 || rejected.Limit.Max != 2 {
+		t.Fatalf("Third request should be rejected while 2 requests are in flight. Result: %+v", rejected)
+	}
+
+	first()
+	if _, rejected := limiter.AcquireInFlight(key, nil); rejected != nil {
+		t.Errorf("Request should acquire the released slot. Result: %+v", rejected)
+	}
+
+	rule := &RateLimit{Key: LimitKey{Path: "/slow"}, MaxInFlight: 3}
+	if _, rejected := limiter.AcquireInFlight(key, rule); rejected != nil {
+		t.Errorf("MaxInFlight of the rule should override the limiter's. Result: %+v", rejected)
+	}
+}
+
+func TestAcquireInFlightWithoutLimit(t *testing.T) {
+	limiter := NewLimiter(10, time.Second, nil)
+	defer limiter.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, rejected := limiter.AcquireInFlight("TestAcquireInFlightWithoutLimit", nil); rejected != nil {
+			t.Fatalf("Requests should not be limited when MaxInFlight is zero. Result: %+v", rejected)
+		}
+	}
+}
@@ -2,25 +2,56 @@
 package config
 
 import (
+	"context"
+	"io"
 	"log"
+	"net/http"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	rate "github.com/aw16com/rate/redis"
+	"github.com/aw16com/tollbooth/store"
 )
 
-// NewLimiter is a constructor for Limiter.
+// NewLimiter is a constructor for Limiter keeping its token buckets in redis.
+// The token buckets are kept in memory when conf is nil.
 func NewLimiter(max int64, ttl time.Duration, conf *rate.ConfigRedis) *Limiter {
+	if conf == nil {
+		return NewLimiterWithStore(max, ttl, store.NewMemory())
+	}
+
+	redisStore, err := store.NewRedisFromConfig(conf)
+	if err != nil {
+		log.Println("fail to set rate limiter's redis: ", err)
+	}
+
+	return NewLimiterWithStore(max, ttl, redisStore)
+}
+
+// NewLimiterWithStore is a constructor for Limiter keeping its token buckets in s.
+// In-flight requests are counted in the same redis when s is a *store.Redis, or a *store.Leasing
+// leasing from one, in memory otherwise.
+func NewLimiterWithStore(max int64, ttl time.Duration, s store.Store) *Limiter {
 	limiter := &Limiter{Max: max, TTL: ttl}
 	limiter.MessageContentType = "text/plain; charset=utf-8"
 	limiter.Message = "You have reached maximum request limit."
 	limiter.StatusCode = 429
-	limiter.tokenBuckets = make(map[string]*rate.Limiter)
 	limiter.IPLookups = []string{"RemoteAddr", "X-Forwarded-For", "X-Real-IP"}
-
-	if err := rate.SetRedis(conf); err != nil {
-		log.Println("fail to set rate limiter's redis: ", err)
+	limiter.HeaderStyle = LegacyHeaders | XRateLimitHeaders
+	limiter.Renderer = NegotiatedRenderer{}
+	limiter.Rules = NewRouter()
+	limiter.Store = s
+	limiter.InFlightTTL = time.Minute
+	limiter.BreakerCooldown = 10 * time.Second
+	limiter.Semaphore = store.NewLocalSemaphore()
+	remote := s
+	if leasing, ok := s.(*store.Leasing); ok {
+		remote = leasing.Remote()
+	}
+	if redisStore, ok := remote.(*store.Redis); ok {
+		limiter.Semaphore = store.NewRedisSemaphore(redisStore.Client())
 	}
 
 	return limiter
@@ -43,6 +74,10 @@ type Limiter struct {
 	// Duration of rate-limiter.
 	TTL time.Duration
 
+	// How requests are counted. Default is store.TokenBucket, which refills one request per TTL.
+	// The sliding-window algorithms allow Max requests in any window of TTL.
+	Algorithm store.Algorithm
+
 	// List of places to look up IP address.
 	// Default is "RemoteAddr", "X-Forwarded-For", "X-Real-IP".
 	// You can rearrange the order as you like.
@@ -59,12 +94,111 @@ type Limiter struct {
 	// List of basic auth usernames to limit.
 	BasicAuthUsers []string
 
-	// Throttler struct
-	tokenBuckets map[string]*rate.Limiter
+	// Extracts the keys of the buckets requests are counted in, in place of IPLookups, Methods,
+	// Headers and BasicAuthUsers. See Keys.
+	KeyFunc KeyFunc
+
+	// Renderer of rejected requests.
+	// Default is NegotiatedRenderer.
+	Renderer Renderer
+
+	// Rate-limit headers set on responses.
+	// Default is LegacyHeaders | XRateLimitHeaders. Retry-After is always set on rejections.
+	HeaderStyle HeaderStyle
+
+	// Called instead of Renderer to write the response of a rejected request.
+	// The rate-limit headers are already set and can still be changed.
+	OnLimitReached func(w http.ResponseWriter, r *http.Request, result *Result)
+
+	// Called with every decision taken on a bucket, allowed or not.
+	// It must be safe for concurrent use.
+	OnDecision func(result *Result)
+
+	// Computes the number of tokens taken by a request, overriding the Cost of API rate limits.
+	// A non-positive cost falls back to the Cost of the rule.
+	CostFunc func(r *http.Request) int64
+
+	// Selects the limit of a request, such as the limit of its plan with Tiers, overriding Max and TTL
+	// and the Val of the API rate limit it matches. Nil falls back to them. See LimitRule.
+	LimitFunc func(r *http.Request) *LimitValue
+
+	// API rate limits overriding Max and TTL for the requests they match.
+	// Limiter.RegisterAPI and Reloader create it when a Limiter literal leaves it nil.
+	Rules *Router
+
+	// Calendar quotas counted in addition to the rate limit, on the same keys.
+	// Requests are only counted when the rate limit allows them.
+	Quotas []Quota
+
+	// Backend keeping the token buckets.
+	Store store.Store
+
+	// Maximum duration of every call to the store and the semaphore, past which the call fails.
+	// Zero means no timeout, calls then only end with the context of the decision.
+	Timeout time.Duration
+
+	// What happens to requests when the store or the semaphore fails. Default is FailOpen.
+	FailurePolicy FailurePolicy
+
+	// Called with every error of the store and the semaphore, as a *StoreError, and with ErrCircuitOpen
+	// when the circuit breaker opens. Default logs them. It must be safe for concurrent use.
+	OnError func(err error)
+
+	// Number of consecutive failures of the store and the semaphore opening the circuit breaker.
+	// While it is open, they are not called and FailurePolicy applies, but for one call every
+	// BreakerCooldown probing whether they recovered. Zero disables the breaker.
+	BreakerThreshold int
+
+	// Duration the circuit breaker stays open before probing the store. Default is 10 seconds.
+	BreakerCooldown time.Duration
+
+	breaker breaker
+
+	// Creates Rules on first use by a Limiter literal.
+	rulesOnce sync.Once
+
+	// Store and semaphore of FailLocal.
+	localOnce      sync.Once
+	localStore     *store.Memory
+	localSemaphore *store.LocalSemaphore
+
+	// Maximum number of requests of a key handled at once. Zero means no limit.
+	MaxInFlight int64
+
+	// Duration after which the slot of an in-flight request is freed if it has not been released,
+	// for instance because the process died. Default is one minute.
+	InFlightTTL time.Duration
+
+	// Backend counting in-flight requests.
+	Semaphore store.Semaphore
+
+	// Maximum duration a request waits for its tokens in wait mode, see Wait. Zero disables waiting.
+	MaxWait time.Duration
+
+	// Maximum number of requests waiting at once in wait mode, the others are rejected at once.
+	// Zero means no limit.
+	MaxQueue int64
+
+	// Number of requests currently waiting, updated atomically.
+	waiting int64
 
 	sync.RWMutex
 }
 
+// HeaderStyle selects the rate-limit headers set on responses. Styles can be combined with |.
+type HeaderStyle int
+
+const (
+	// LegacyHeaders sets X-Rate-Limit-Limit and X-Rate-Limit-Duration.
+	LegacyHeaders HeaderStyle = 1 << iota
+
+	// XRateLimitHeaders sets X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset.
+	XRateLimitHeaders
+
+	// IETFHeaders sets the RateLimit and RateLimit-Policy fields of the IETF httpapi draft.
+	IETFHeaders
+)
+
 // By is the type of a "less" function that defines the ordering of its RateLimit arguments.
 type By func(l1, l2 *RateLimit) bool
 
@@ -98,35 +232,428 @@ func (s *limitSorter) Less(i, j int) bool {
 type RateLimit struct {
 	Key LimitKey
 	Val LimitValue
+
+	// Additional limits enforced together with Val on the same key, such as 1000 requests per hour
+	// on top of 10 per second. A request is rejected when any of them is exceeded, and then counted
+	// by none of them. The memory and redis stores check and take every limit at once. Other stores
+	// are checked first and taken one limit after another, so concurrent requests may see tokens
+	// taken by a request finally rejected, which are given back only by a store.Refunder.
+	Limits []LimitValue
+
+	// Rate limits of higher priority are matched first.
+	Priority int
+
+	// Number of tokens taken by each matching request. Zero means 1.
+	Cost int64
+
+	// Maximum number of matching requests of a key handled at once, overriding the limiter's MaxInFlight.
+	MaxInFlight int64
 }
 
 // LimitKey defines the limited API's key.
 type LimitKey struct {
-	Path   string
+	Path string
+
+	// HTTP method, empty or "*" matches every method. Before Router, an empty method matched no request.
 	Method string
+
+	// How Path is compared to request paths. Default is MatchRegexp.
+	Match MatchType
 }
 
 // LimitValue defines the API's rate limit.
 type LimitValue struct {
 	Max int64
 	TTL time.Duration
+
+	// How requests are counted, the limiter's Algorithm when zero.
+	Algorithm store.Algorithm
 }
 
-// LimitReached returns a bool indicating if the Bucket identified by key ran out of tokens.
-func (l *Limiter) LimitReached(key string, limitVal *LimitValue) bool {
-	l.Lock()
-	defer l.Unlock()
-	if _, found := l.tokenBuckets[key]; !found {
-		var (
-			TTL = l.TTL
-			Max = l.Max
-		)
-		if limitVal != nil {
-			TTL = limitVal.TTL
-			Max = limitVal.Max
+func (v LimitValue) storeLimit() store.Limit {
+	return store.Limit{Max: v.Max, TTL: v.TTL, Algorithm: v.Algorithm}
+}
+
+// bucketKey returns the key of the bucket counting the requests of key for the i-th limit of a rule.
+// The first limit uses key itself.
+func (v LimitValue) bucketKey(key string, i int) string {
+	if i == 0 {
+		return key
+	}
+	key += ":" + strconv.FormatInt(v.Max, 10) + "/" + v.TTL.String()
+	if v.Algorithm != 0 {
+		key += ":" + v.Algorithm.String()
+	}
+	return key
+}
+
+// Window returns the duration over which Max requests are allowed,
+// the time needed to refill the whole bucket of a token bucket.
+func (v LimitValue) Window() time.Duration {
+	switch v.Algorithm {
+	case store.SlidingWindowLog, store.SlidingWindowCounter, store.FixedWindow:
+		return v.TTL
+	default:
+		return time.Duration(v.Max) * v.TTL
+	}
+}
+
+// Result describes the decision taken for a request on the bucket that was consulted.
+type Result struct {
+	// Whether the request is allowed.
+	Allowed bool
+
+	// Key of the consulted bucket.
+	Key string
+
+	// Limit applied to the bucket.
+	Limit LimitValue
+
+	// Number of requests left in the bucket.
+	Remaining int64
+
+	// Time at which the bucket is full again.
+	ResetAt time.Time
+
+	// Duration to wait before the request can be allowed, zero when it is allowed.
+	RetryAfter time.Duration
+
+	// API rate limit that applied to the request, nil when the limiter defaults applied.
+	Rule *RateLimit
+
+	// Quota that rejected the request, nil otherwise. Limit then reports the quota and its period.
+	Quota *Quota
+
+	// Number of tokens the request took, or would have taken when it is rejected.
+	Cost int64
+
+	// Number of requests of the key in flight when the request was rejected because of MaxInFlight.
+	// Limit.Max then reports MaxInFlight.
+	InFlight int64
+
+	// Whether the request was rejected because of MaxInFlight. Limit then has no TTL,
+	// so no policy applies to the rejection.
+	InFlightRejected bool
+
+	// Time the request waited for its tokens in wait mode.
+	Waited time.Duration
+
+	// Error of the store or the semaphore when the decision was taken by FailurePolicy.
+	Err error
+}
+
+// RetryAfterSeconds returns RetryAfter rounded up to whole seconds.
+func (r *Result) RetryAfterSeconds() int64 {
+	return ceilSeconds(r.RetryAfter)
+}
+
+// WindowSeconds returns the window of Limit rounded up to whole seconds.
+func (r *Result) WindowSeconds() int64 {
+	return ceilSeconds(r.Limit.Window())
+}
+
+// ResetSeconds returns the time left until ResetAt rounded up to whole seconds.
+func (r *Result) ResetSeconds() int64 {
+	return ceilSeconds(time.Until(r.ResetAt))
+}
+
+// ceilSeconds rounds d up to whole seconds, negative durations count as zero.
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// Allow takes a token from the Bucket identified by key and returns the decision.
+// The limiter's FailurePolicy decides when the store fails. The store synchronizes concurrent calls itself.
+func (l *Limiter) Allow(key string, limitVal *LimitValue) *Result {
+	return l.AllowContext(context.Background(), key, limitVal)
+}
+
+// AllowContext is Allow calling the store with ctx. The limiter's FailurePolicy decides when ctx is done
+// before the store answers.
+func (l *Limiter) AllowContext(ctx context.Context, key string, limitVal *LimitValue) *Result {
+	return l.AllowNContext(ctx, key, limitVal, 1)
+}
+
+// AllowN is Allow taking n tokens at once, for requests more expensive than others.
+// An n below 1 takes a single token, so that no request is free or gives tokens back.
+func (l *Limiter) AllowN(key string, limitVal *LimitValue, n int64) *Result {
+	return l.AllowNContext(context.Background(), key, limitVal, n)
+}
+
+// AllowNContext is AllowN calling the store with ctx.
+func (l *Limiter) AllowNContext(ctx context.Context, key string, limitVal *LimitValue, n int64) *Result {
+	return l.decide(l.take(ctx, key, limitVal, nil, n))
+}
+
+// AllowRule is Allow limited by the value of rule, or by the limiter defaults when rule is nil.
+// It takes the Cost of rule.
+func (l *Limiter) AllowRule(key string, rule *RateLimit) *Result {
+	return l.AllowRuleContext(context.Background(), key, rule)
+}
+
+// AllowRuleContext is AllowRule calling the store with ctx.
+func (l *Limiter) AllowRuleContext(ctx context.Context, key string, rule *RateLimit) *Result {
+	return l.AllowRuleNContext(ctx, key, rule, l.Cost(nil, rule))
+}
+
+// AllowRuleN is AllowRule taking n tokens at once.
+func (l *Limiter) AllowRuleN(key string, rule *RateLimit, n int64) *Result {
+	return l.AllowRuleNContext(context.Background(), key, rule, n)
+}
+
+// AllowRuleNContext is AllowRuleN calling the store with ctx.
+func (l *Limiter) AllowRuleNContext(ctx context.Context, key string, rule *RateLimit, n int64) *Result {
+	return l.decide(l.takeRule(ctx, key, rule, n))
+}
+
+// Cost returns the number of tokens taken by r: the cost computed by CostFunc, or the Cost of rule, or 1.
+// r may be nil to get the cost of rule.
+func (l *Limiter) Cost(r *http.Request, rule *RateLimit) int64 {
+	if r != nil && l.CostFunc != nil {
+		if cost := l.CostFunc(r); cost > 0 {
+			return cost
+		}
+	}
+	if rule != nil && rule.Cost > 0 {
+		return rule.Cost
+	}
+	return 1
+}
+
+// LimitRule returns rule limited by the limit LimitFunc selects for r, or rule itself when it selects none.
+// Requests matching no API rate limit are then limited by a RateLimit holding only that limit.
+func (l *Limiter) LimitRule(r *http.Request, rule *RateLimit) *RateLimit {
+	if l.LimitFunc == nil {
+		return rule
+	}
+	limit := l.LimitFunc(r)
+	if limit == nil {
+		return rule
+	}
+
+	limited := RateLimit{}
+	if rule != nil {
+		limited = *rule
+	}
+	limited.Val = *limit
+	return &limited
+}
+
+// takeRule takes n tokens limited by the value of rule, or by the limiter defaults when rule is nil.
+func (l *Limiter) takeRule(ctx context.Context, key string, rule *RateLimit, n int64) *Result {
+	if rule == nil {
+		return l.take(ctx, key, nil, nil, n)
+	}
+	return l.take(ctx, key, &rule.Val, rule, n)
+}
+
+// take takes n tokens from the buckets of key and its quotas, without reporting the decision to OnDecision.
+// Every decision goes through take, which takes at least one token.
+func (l *Limiter) take(ctx context.Context, key string, limitVal *LimitValue, rule *RateLimit, n int64) *Result {
+	if n < 1 {
+		n = 1
+	}
+
+	limits := []LimitValue{{Max: l.Max, TTL: l.TTL}}
+	if limitVal != nil {
+		limits[0] = *limitVal
+	}
+	if rule != nil {
+		limits = append(limits, rule.Limits...)
+	}
+
+	now := time.Now()
+	buckets := make([]bucket, 0, len(limits)+len(l.Quotas))
+	for i := range limits {
+		if limits[i].Algorithm == 0 {
+			limits[i].Algorithm = l.Algorithm
+		}
+		buckets = append(buckets, bucket{key: limits[i].bucketKey(key, i), limit: limits[i].storeLimit()})
+	}
+	for _, quota := range l.Quotas {
+		quotaKey, quotaLimit, _ := quota.bucket(key, now)
+		buckets = append(buckets, bucket{key: quotaKey, limit: quotaLimit})
+	}
+
+	states, err := l.takeBuckets(ctx, buckets, n)
+	result := &Result{Key: key, Rule: rule, Cost: n, Err: err}
+	for i, state := range states {
+		if i >= len(limits) {
+			if !state.Allowed {
+				l.rejectQuota(result, l.Quotas[i-len(limits)], state, err != nil && !buckets[i].local, now)
+				break
+			}
+			continue
+		}
+		if !state.Allowed {
+			result.setState(limits[i], state)
+			break
+		}
+		if i == 0 || moreRestrictive(state, result) {
+			result.setState(limits[i], state)
+		}
+	}
+	return result
+}
+
+// decide reports result to OnDecision and returns it.
+func (l *Limiter) decide(result *Result) *Result {
+	if l.OnDecision != nil {
+		l.OnDecision(result)
+	}
+	return result
+}
+
+// bucket identifies a bucket of the store and the limit applied to it.
+type bucket struct {
+	key   string
+	limit store.Limit
+
+	// Whether the bucket is kept by the local store of FailLocal because the store failed.
+	local bool
+}
+
+// takeBucket takes n tokens from b, applying FailurePolicy when the store fails.
+func (l *Limiter) takeBucket(ctx context.Context, b *bucket, n int64) (store.State, error) {
+	var state store.State
+	err := l.call(ctx, "take", b.key, func(ctx context.Context) (err error) {
+		state, err = l.Store.Take(ctx, b.key, b.limit, n)
+		return err
+	})
+	if err != nil {
+		state, b.local = l.failureState(ctx, b.key, b.limit, n)
+	}
+	return state, err
+}
+
+// takeBuckets takes n tokens from every bucket, or from none of them when one denies the request,
+// applying FailurePolicy when the store fails. It returns the states of the buckets up to the first
+// denying one. A store.MultiTaker checks and takes the buckets at once. Other stores are peeked first,
+// then taken one after another: a bucket emptied by a concurrent request in between may still deny
+// the request, the tokens taken from the previous buckets are then given back if the store is
+// a store.Refunder.
+func (l *Limiter) takeBuckets(ctx context.Context, buckets []bucket, n int64) ([]store.State, error) {
+	if len(buckets) == 1 {
+		state, err := l.takeBucket(ctx, &buckets[0], n)
+		return []store.State{state}, err
+	}
+
+	if multiTaker, ok := l.Store.(store.MultiTaker); ok {
+		keys, limits := bucketArgs(buckets)
+		var states []store.State
+		err := l.call(ctx, "take", keys[0], func(ctx context.Context) (err error) {
+			states, err = multiTaker.TakeAll(ctx, keys, limits, n)
+			return err
+		})
+		if err != nil {
+			return l.failureStates(ctx, buckets, n), err
+		}
+		return states, nil
+	}
+
+	peeked := make([]store.State, 0, len(buckets))
+	for _, b := range buckets {
+		var state store.State
+		err := l.call(ctx, "peek", b.key, func(ctx context.Context) (err error) {
+			state, err = l.Store.Peek(ctx, b.key, b.limit)
+			return err
+		})
+		if err != nil {
+			return l.failureStates(ctx, buckets, n), err
+		}
+		if !state.Allowed || state.Remaining < n {
+			state.Allowed = false
+			return append(peeked, state), nil
+		}
+		peeked = append(peeked, state)
+	}
+
+	var taken []bucket
+	var err error
+	states := make([]store.State, 0, len(buckets))
+	for i := range buckets {
+		state, takeErr := l.takeBucket(ctx, &buckets[i], n)
+		if takeErr != nil {
+			err = takeErr
+		}
+		states = append(states, state)
+
+		if !state.Allowed {
+			// The other buckets must not count a rejected request.
+			l.refund(ctx, taken, n)
+			break
+		}
+		if takeErr == nil || buckets[i].local {
+			taken = append(taken, buckets[i])
+		}
+	}
+	return states, err
+}
+
+// bucketArgs returns the keys and limits of buckets.
+func bucketArgs(buckets []bucket) ([]string, []store.Limit) {
+	keys, limits := make([]string, len(buckets)), make([]store.Limit, len(buckets))
+	for i, b := range buckets {
+		keys[i], limits[i] = b.key, b.limit
+	}
+	return keys, limits
+}
+
+// refund gives back the n tokens taken from buckets when the store supports it.
+func (l *Limiter) refund(ctx context.Context, buckets []bucket, n int64) {
+	for _, b := range buckets {
+		if b.local {
+			local, _ := l.local()
+			local.Refund(ctx, b.key, b.limit, n)
+			continue
+		}
+
+		if refunder, ok := l.Store.(store.Refunder); ok {
+			l.call(ctx, "refund", b.key, func(ctx context.Context) error {
+				return refunder.Refund(ctx, b.key, b.limit, n)
+			})
 		}
-		l.tokenBuckets[key] = rate.NewLimiter(rate.Every(TTL), int(Max), key)
 	}
+}
 
-	return !l.tokenBuckets[key].AllowN(time.Now(), 1)
+// setState reports state of a bucket limited by limit in r.
+func (r *Result) setState(limit LimitValue, state store.State) {
+	r.Allowed = state.Allowed
+	r.Limit = limit
+	r.Remaining = state.Remaining
+	r.ResetAt = state.ResetAt
+	r.RetryAfter = state.RetryAfter
+}
+
+// moreRestrictive reports whether state leaves fewer requests than the bucket reported in result,
+// or as many for longer.
+func moreRestrictive(state store.State, result *Result) bool {
+	if state.Remaining != result.Remaining {
+		return state.Remaining < result.Remaining
+	}
+	return state.ResetAt.After(result.ResetAt)
+}
+
+// LimitReached returns a bool indicating if the Bucket identified by key ran out of tokens.
+func (l *Limiter) LimitReached(key string, limitVal *LimitValue) bool {
+	return l.LimitReachedContext(context.Background(), key, limitVal)
+}
+
+// LimitReachedContext is LimitReached calling the store with ctx.
+func (l *Limiter) LimitReachedContext(ctx context.Context, key string, limitVal *LimitValue) bool {
+	return !l.AllowContext(ctx, key, limitVal).Allowed
+}
+
+// Close releases the resources of the store, such as the janitor of a memory store.
+func (l *Limiter) Close() error {
+	if l.localStore != nil {
+		l.localStore.Close()
+	}
+	if closer, ok := l.Store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
@@ -1,10 +1,12 @@
 package config
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
 	rate "github.com/aw16com/rate/redis"
+	"github.com/aw16com/tollbooth/store"
 )
 
 func BenchmarkLimitReached(b *testing.B) {
@@ -19,3 +21,44 @@ func BenchmarkLimitReached(b *testing.B) {
 		limiter.LimitReached(key, nil)
 	}
 }
+
+func BenchmarkLimitReachedInMemory(b *testing.B) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	key := "127.0.0.1|/"
+
+	for i := 0; i < b.N; i++ {
+		limiter.LimitReached(key, nil)
+	}
+}
+
+// Run with -cpu 1,2,4,8 to see the throughput scale with GOMAXPROCS.
+func BenchmarkLimitReachedInMemoryParallel(b *testing.B) {
+	benchmarkLimitReachedParallel(b, store.NewMemory())
+}
+
+// Same as BenchmarkLimitReachedInMemoryParallel with every key behind a single lock.
+func BenchmarkLimitReachedInMemoryParallelSingleShard(b *testing.B) {
+	conf := store.DefaultMemoryConfig
+	conf.Shards = 1
+	benchmarkLimitReachedParallel(b, store.NewMemoryWithConfig(conf))
+}
+
+func benchmarkLimitReachedParallel(b *testing.B, s *store.Memory) {
+	limiter := NewLimiterWithStore(1, time.Second, s)
+	defer limiter.Close()
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "10.0.0." + strconv.Itoa(i) + "|/"
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			limiter.LimitReached(keys[i%len(keys)], nil)
+			i++
+		}
+	})
+}
@@ -1,12 +1,64 @@
 package config
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
 	"testing"
 	"time"
 
 	rate "github.com/aw16com/rate/redis"
+	"github.com/aw16com/tollbooth/store"
 )
 
+// countingStore allows the first Max takes of every key.
+type countingStore struct {
+	taken map[string]int64
+
+	// Limit of the last take.
+	limit store.Limit
+}
+
+func (s *countingStore) Take(ctx context.Context, key string, limit store.Limit, n int64) (store.State, error) {
+	s.limit = limit
+	if s.taken[key]+n > limit.Max {
+		return store.State{Remaining: limit.Max - s.taken[key]}, nil
+	}
+	s.taken[key] += n
+	return store.State{Allowed: true, Remaining: limit.Max - s.taken[key]}, nil
+}
+
+func (s *countingStore) Peek(ctx context.Context, key string, limit store.Limit) (store.State, error) {
+	return store.State{Allowed: s.taken[key] < limit.Max, Remaining: limit.Max - s.taken[key]}, nil
+}
+
+func (s *countingStore) Reset(ctx context.Context, key string) error {
+	delete(s.taken, key)
+	return nil
+}
+
+// blockingStore answers once the context of the call is done, like an unreachable server.
+type blockingStore struct {
+	// Error of the last call.
+	err error
+}
+
+func (s *blockingStore) Take(ctx context.Context, key string, limit store.Limit, n int64) (store.State, error) {
+	<-ctx.Done()
+	s.err = ctx.Err()
+	return store.State{}, s.err
+}
+
+func (s *blockingStore) Peek(ctx context.Context, key string, limit store.Limit) (store.State, error) {
+	return s.Take(ctx, key, limit, 1)
+}
+
+func (s *blockingStore) Reset(ctx context.Context, key string) error {
+	_, err := s.Take(ctx, key, store.Limit{}, 1)
+	return err
+}
+
 func TestConstructor(t *testing.T) {
 	limiter := NewLimiter(1, time.Second, &rate.ConfigRedis{
 		Host: "127.0.0.1",
@@ -58,6 +110,9 @@ func TestMuchHigherMaxRequests(t *testing.T) {
 	})
 	key := "TestMuchHigherMaxRequests"
 
+	// Redis refills token buckets on whole seconds, start right after one so that the requests
+	// are not refilled by the next one.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
 	for i := 0; i < numRequests; i++ {
 		if limiter.LimitReached(key, nil) == true {
 			t.Errorf("N(%v) limit should not be reached.", i)
@@ -69,3 +124,298 @@ func TestMuchHigherMaxRequests(t *testing.T) {
 	}
 
 }
+
+func TestLimitReachedWithStore(t *testing.T) {
+	s := &countingStore{taken: make(map[string]int64)}
+	limiter := NewLimiterWithStore(1, time.Second, s)
+	key := "TestLimitReachedWithStore"
+
+	if limiter.LimitReached(key, nil) == true {
+		t.Error("First time count should not reached the limit.")
+	}
+	if limiter.LimitReached(key, nil) == false {
+		t.Error("Second time count should reach the limit of the store.")
+	}
+	if limiter.LimitReached(key, &LimitValue{Max: 2, TTL: time.Second}) == true {
+		t.Error("The limit value should be passed to the store.")
+	}
+	if s.taken[key] != 2 {
+		t.Errorf("Store should have been called for key. Taken: %v", s.taken[key])
+	}
+}
+
+func TestLimitReachedInMemory(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	key := "TestLimitReachedInMemory"
+
+	if _, ok := limiter.Store.(*store.Memory); !ok {
+		t.Fatalf("Store should be kept in memory without redis config. Store: %T", limiter.Store)
+	}
+	if limiter.LimitReached(key, nil) == true {
+		t.Error("First time count should not reached the limit.")
+	}
+	if limiter.LimitReached(key, nil) == false {
+		t.Error("Second time count should return true because it exceeds 1 request per second.")
+	}
+	if err := limiter.Close(); err != nil {
+		t.Errorf("Close should stop the janitor of the memory store. Error: %v", err)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	limiter := NewLimiter(2, time.Second, nil)
+	defer limiter.Close()
+	key := "TestAllow"
+
+	result := limiter.Allow(key, nil)
+	if !result.Allowed || result.Remaining != 1 || result.RetryAfter != 0 {
+		t.Errorf("First request should be allowed with 1 request left. Result: %+v", result)
+	}
+	if result.Limit.Max != 2 || result.Limit.TTL != time.Second {
+		t.Errorf("Result should carry the limiter defaults. Limit: %+v", result.Limit)
+	}
+	if result.ResetAt.Before(time.Now()) {
+		t.Errorf("Bucket should be refilled in the future. ResetAt: %v", result.ResetAt)
+	}
+
+	limiter.Allow(key, nil)
+	result = limiter.Allow(key, nil)
+	if result.Allowed || result.Remaining != 0 {
+		t.Errorf("Third request should be denied. Result: %+v", result)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("RetryAfter should be within one TTL. RetryAfter: %v", result.RetryAfter)
+	}
+
+	result = limiter.Allow(key+"WithLimitValue", &LimitValue{Max: 5, TTL: time.Minute})
+	if result.Limit.Max != 5 || result.Remaining != 4 {
+		t.Errorf("Result should carry the given limit value. Result: %+v", result)
+	}
+}
+
+func TestAllowAlgorithm(t *testing.T) {
+	counting := &countingStore{taken: make(map[string]int64)}
+	limiter := NewLimiterWithStore(2, time.Minute, counting)
+	limiter.Algorithm = store.SlidingWindowLog
+
+	result := limiter.Allow("TestAllowAlgorithm", nil)
+	if counting.limit.Algorithm != store.SlidingWindowLog || result.Limit.Algorithm != store.SlidingWindowLog {
+		t.Errorf("Limiter algorithm should be used by default. Limit: %+v", counting.limit)
+	}
+	if result.Limit.Window() != time.Minute {
+		t.Errorf("Window of a sliding window should be its TTL. Window: %v", result.Limit.Window())
+	}
+
+	limiter.Allow("TestAllowAlgorithm", &LimitValue{Max: 2, TTL: time.Minute, Algorithm: store.SlidingWindowCounter})
+	if counting.limit.Algorithm != store.SlidingWindowCounter {
+		t.Errorf("Limit value algorithm should override the limiter's. Limit: %+v", counting.limit)
+	}
+
+	limiter.Algorithm = 0
+	result = limiter.Allow("TestAllowAlgorithm", nil)
+	if result.Limit.Window() != 2*time.Minute {
+		t.Errorf("Window of a token bucket should be the time to refill it. Window: %v", result.Limit.Window())
+	}
+}
+
+func TestAllowGCRA(t *testing.T) {
+	limiter := NewLimiter(2, time.Second, nil)
+	defer limiter.Close()
+	limiter.Algorithm = store.GCRA
+	key := "TestAllowGCRA"
+
+	limiter.Allow(key, nil)
+	if result := limiter.Allow(key, nil); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Second request should be allowed with no request left. Result: %+v", result)
+	}
+
+	result := limiter.Allow(key, nil)
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("Third request should be denied for at most one TTL. Result: %+v", result)
+	}
+	if result.Limit.Window() != 2*time.Second {
+		t.Errorf("Window of GCRA should be the time to accept a whole burst again. Window: %v", result.Limit.Window())
+	}
+}
+
+func TestAllowRuleLimits(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	key := "TestAllowRuleLimits"
+
+	rule := &RateLimit{
+		Key:    LimitKey{Path: "/", Method: "GET"},
+		Val:    LimitValue{Max: 10, TTL: time.Second},
+		Limits: []LimitValue{{Max: 3, TTL: time.Hour}},
+	}
+
+	result := limiter.AllowRule(key, rule)
+	if !result.Allowed || result.Limit.Max != 3 || result.Remaining != 2 {
+		t.Errorf("Result should report the most restrictive limit. Result: %+v", result)
+	}
+
+	limiter.AllowRule(key, rule)
+	limiter.AllowRule(key, rule)
+	result = limiter.AllowRule(key, rule)
+	if result.Allowed || result.Limit.TTL != time.Hour || result.RetryAfter <= time.Second {
+		t.Errorf("Fourth request should be rejected by the hourly limit. Result: %+v", result)
+	}
+
+	state, _ := limiter.Store.Peek(context.Background(), key, store.Limit{Max: 10, TTL: time.Second})
+	if state.Remaining != 7 {
+		t.Errorf("Rejected request should not be counted by the other limits. Remaining: %v", state.Remaining)
+	}
+}
+
+// plainStore hides the optional interfaces, such as store.MultiTaker and store.Refunder, of the store it wraps.
+type plainStore struct {
+	store.Store
+}
+
+func TestAllowRuleLimitsPlainStore(t *testing.T) {
+	memory := store.NewMemory()
+	defer memory.Close()
+	limiter := NewLimiterWithStore(1, time.Second, plainStore{memory})
+	key := "TestAllowRuleLimitsPlainStore"
+
+	rule := &RateLimit{
+		Key:    LimitKey{Path: "/", Method: "GET"},
+		Val:    LimitValue{Max: 10, TTL: time.Second},
+		Limits: []LimitValue{{Max: 1, TTL: time.Hour}},
+	}
+	limiter.AllowRule(key, rule)
+	if result := limiter.AllowRule(key, rule); result.Allowed || result.Limit.TTL != time.Hour {
+		t.Errorf("Second request should be rejected by the hourly limit. Result: %+v", result)
+	}
+
+	state, _ := memory.Peek(context.Background(), key, store.Limit{Max: 10, TTL: time.Second})
+	if state.Remaining != 9 {
+		t.Errorf("Rejected request should not be counted by the other limits of a store without refunds. Remaining: %v", state.Remaining)
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	limiter := NewLimiter(10, time.Minute, nil)
+	defer limiter.Close()
+	key := "TestAllowN"
+
+	result := limiter.AllowN(key, nil, 6)
+	if !result.Allowed || result.Remaining != 4 || result.Cost != 6 {
+		t.Errorf("Request should take 6 tokens. Result: %+v", result)
+	}
+	result = limiter.AllowN(key, nil, 6)
+	if result.Allowed || result.Remaining != 4 {
+		t.Errorf("Request should be rejected without taking any token. Result: %+v", result)
+	}
+
+	rule := &RateLimit{Key: LimitKey{Path: "/export"}, Val: LimitValue{Max: 10, TTL: time.Minute}, Cost: 4}
+	if result := limiter.AllowRule(key+"Rule", rule); result.Remaining != 6 {
+		t.Errorf("Rule request should take the cost of the rule. Result: %+v", result)
+	}
+}
+
+func TestAllowNNotPositive(t *testing.T) {
+	limiter := NewLimiter(2, time.Minute, nil)
+	defer limiter.Close()
+	limiter.Quotas = []Quota{{Max: 2, Period: Daily}}
+	key := "TestAllowNNotPositive"
+
+	for _, n := range []int64{-5, 0} {
+		if result := limiter.AllowN(key, nil, n); !result.Allowed || result.Cost != 1 {
+			t.Errorf("Request of %v tokens should take a single token. Result: %+v", n, result)
+		}
+	}
+	if result := limiter.AllowN(key, &LimitValue{Max: 2, TTL: time.Minute, Algorithm: store.FixedWindow}, -5); result.Allowed {
+		t.Errorf("Negative requests should not give tokens back to the quota. Result: %+v", result)
+	}
+	if result := limiter.Allow(key, nil); result.Allowed {
+		t.Errorf("Negative requests should not give tokens back to the rate limit. Result: %+v", result)
+	}
+}
+
+func TestAllowContext(t *testing.T) {
+	blocking := &blockingStore{}
+	limiter := NewLimiterWithStore(1, time.Second, blocking)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := limiter.AllowContext(ctx, "TestAllowContext", nil); !result.Allowed {
+		t.Errorf("Request should be let through when the context is done. Result: %+v", result)
+	}
+	if blocking.err != context.Canceled {
+		t.Errorf("Store should be called with the context. Error: %v", blocking.err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	blocking := &blockingStore{}
+	limiter := NewLimiterWithStore(1, time.Second, blocking)
+	limiter.Timeout = 20 * time.Millisecond
+	limiter.Quotas = []Quota{{Max: 10, Period: Daily}}
+
+	start := time.Now()
+	if result := limiter.Allow("TestTimeout", nil); !result.Allowed {
+		t.Errorf("Request should be let through when the store times out. Result: %+v", result)
+	}
+	if blocking.err != context.DeadlineExceeded {
+		t.Errorf("Store call should time out. Error: %v", blocking.err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Every store call should be bounded by Timeout. Elapsed: %v", elapsed)
+	}
+
+	if _, err := limiter.QuotaUsage("TestTimeout"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("QuotaUsage should time out. Error: %v", err)
+	}
+}
+
+func TestCost(t *testing.T) {
+	limiter := NewLimiter(10, time.Minute, nil)
+	defer limiter.Close()
+	rule := &RateLimit{Cost: 3}
+	request, _ := http.NewRequest("GET", "/search?size=500", nil)
+
+	if cost := limiter.Cost(request, nil); cost != 1 {
+		t.Errorf("Default cost should be 1. Cost: %v", cost)
+	}
+	if cost := limiter.Cost(request, rule); cost != 3 {
+		t.Errorf("Cost should be the cost of the rule. Cost: %v", cost)
+	}
+
+	limiter.CostFunc = func(r *http.Request) int64 {
+		size, _ := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		return size / 100
+	}
+	if cost := limiter.Cost(request, rule); cost != 5 {
+		t.Errorf("CostFunc should override the cost of the rule. Cost: %v", cost)
+	}
+
+	request, _ = http.NewRequest("GET", "/search", nil)
+	if cost := limiter.Cost(request, rule); cost != 3 {
+		t.Errorf("Non-positive costs should fall back to the cost of the rule. Cost: %v", cost)
+	}
+}
+
+func TestOnDecision(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+
+	var decisions []*Result
+	limiter.OnDecision = func(result *Result) {
+		decisions = append(decisions, result)
+	}
+
+	rule := &RateLimit{Key: LimitKey{Path: "/", Method: "GET"}, Val: LimitValue{Max: 1, TTL: time.Second}}
+	limiter.AllowRule("TestOnDecision", rule)
+	limiter.AllowRule("TestOnDecision", rule)
+
+	if len(decisions) != 2 {
+		t.Fatalf("OnDecision should be called for every decision. Calls: %v", len(decisions))
+	}
+	if !decisions[0].Allowed || decisions[1].Allowed {
+		t.Errorf("OnDecision should see the first request allowed and the second denied.")
+	}
+	if decisions[1].Key != "TestOnDecision" || decisions[1].Rule != rule {
+		t.Errorf("OnDecision should see the key and rule of the bucket. Result: %+v", decisions[1])
+	}
+}
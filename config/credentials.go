@@ -0,0 +1,84 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// DefaultAPIKeyNames are the header and query parameter APIKey looks for when none is given.
+var DefaultAPIKeyNames = []string{"X-API-Key", "api_key"}
+
+// APIKey extracts the API key of the request from the first of names set as a header or as a query
+// parameter, DefaultAPIKeyNames when none is given. Only the key is extracted, so that it shares its
+// bucket wherever it is sent. Combine it with Hashed to keep it out of the store.
+// Keys are not validated: a client sending a new random key on every request gets a fresh bucket
+// every time, so also count requests in a key of their IP or route, such as
+//
+//	apiKey, ip := Keys(Constant("key"), Hashed(APIKey())), Keys(Constant("ip"), IP())
+//	limiter.KeyFunc = func(r *http.Request) [][]string { return append(apiKey(r), ip(r)...) }
+func APIKey(names ...string) KeyFunc {
+	if len(names) == 0 {
+		names = DefaultAPIKeyNames
+	}
+	return func(r *http.Request) [][]string {
+		for _, name := range names {
+			if key := r.Header.Get(name); key != "" {
+				return [][]string{{key}}
+			}
+			if key := r.URL.Query().Get(name); key != "" {
+				return [][]string{{key}}
+			}
+		}
+		return nil
+	}
+}
+
+// BearerToken extracts the bearer token of the Authorization header.
+// Combine it with Hashed to keep it out of the store.
+func BearerToken() KeyFunc {
+	return func(r *http.Request) [][]string {
+		return single(bearerToken(r))
+	}
+}
+
+// Hashed replaces every key of extractor by the hex SHA-256 of its parts, so that
+// credentials are not stored in clear.
+func Hashed(extractor KeyFunc) KeyFunc {
+	return func(r *http.Request) [][]string {
+		sliceKeys := extractor(r)
+		for i, keys := range sliceKeys {
+			sum := sha256.Sum256([]byte(strings.Join(keys, "|")))
+			sliceKeys[i] = []string{hex.EncodeToString(sum[:])}
+		}
+		return sliceKeys
+	}
+}
+
+// Fallback extracts the keys of extractor, or the keys of fallback when it has none,
+// such as an anonymous bucket for requests without credentials.
+func Fallback(extractor KeyFunc, fallback KeyFunc) KeyFunc {
+	return func(r *http.Request) [][]string {
+		if sliceKeys := extractor(r); len(sliceKeys) > 0 {
+			return sliceKeys
+		}
+		return fallback(r)
+	}
+}
+
+// Constant extracts part from every request.
+func Constant(part string) KeyFunc {
+	return func(r *http.Request) [][]string {
+		return [][]string{{part}}
+	}
+}
+
+// bearerToken returns the token of the Authorization header of r when its scheme is Bearer.
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[7:])
+}
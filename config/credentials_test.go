@@ -0,0 +1,97 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKey(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/search?api_key=k1", nil)
+	if keys := APIKey()(request); !reflect.DeepEqual(keys, [][]string{{"k1"}}) {
+		t.Errorf("API key should be read from the query. Keys: %v", keys)
+	}
+
+	request.Header.Set("X-API-Key", "k2")
+	if keys := APIKey()(request); !reflect.DeepEqual(keys, [][]string{{"k2"}}) {
+		t.Errorf("API key should be read from the first name found. Keys: %v", keys)
+	}
+	if keys := APIKey("key")(request); len(keys) != 0 {
+		t.Errorf("Requests without API key should have no key. Keys: %v", keys)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	cases := map[string][][]string{
+		"Bearer t1":     {{"t1"}},
+		"bearer  t2 ":   {{"t2"}},
+		"Basic Ym9iOng": nil,
+		"Bearer":        nil,
+		"":              nil,
+	}
+
+	for authorization, expected := range cases {
+		request, _ := http.NewRequest("GET", "/", nil)
+		request.Header.Set("Authorization", authorization)
+		if keys := BearerToken()(request); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Token of %q is incorrect. Keys: %v, Expected: %v", authorization, keys, expected)
+		}
+	}
+}
+
+func TestHashed(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+
+	sum := sha256.Sum256([]byte("secret"))
+	keys := Keys(Hashed(BearerToken()), Path())(request)
+	if !reflect.DeepEqual(keys, [][]string{{hex.EncodeToString(sum[:]), "/"}}) {
+		t.Errorf("Token should be replaced by its hash. Keys: %v", keys)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	keyFunc := Keys(Fallback(Hashed(APIKey()), Constant("anonymous")), Path())
+
+	request, _ := http.NewRequest("GET", "/search", nil)
+	if keys := keyFunc(request); !reflect.DeepEqual(keys, [][]string{{"anonymous", "/search"}}) {
+		t.Errorf("Requests without API key should share the anonymous bucket. Keys: %v", keys)
+	}
+
+	request.Header.Set("X-API-Key", "k1")
+	if keys := keyFunc(request); len(keys) != 1 || keys[0][0] == "anonymous" || keys[0][0] == "k1" {
+		t.Errorf("Requests with an API key should use its hash. Keys: %v", keys)
+	}
+}
+
+func TestAPIKeyAndIP(t *testing.T) {
+	limiter := NewLimiter(2, time.Minute, nil)
+	defer limiter.Close()
+	apiKey, ip := Keys(Constant("key"), Hashed(APIKey())), Keys(Constant("ip"), IP("RemoteAddr"))
+	limiter.KeyFunc = func(r *http.Request) [][]string { return append(apiKey(r), ip(r)...) }
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		request, _ := http.NewRequest("GET", "/search", nil)
+		request.RemoteAddr = "10.0.0.1:1234"
+		request.Header.Set("X-API-Key", "k"+strconv.Itoa(i))
+
+		reached := false
+		for _, keys := range limiter.Keys(request) {
+			if limiter.LimitReached(strings.Join(keys, "|"), nil) {
+				reached = true
+			}
+		}
+		if !reached {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Rotating API keys should not bypass the IP limit. Allowed: %v", allowed)
+	}
+}
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aw16com/tollbooth/store"
+)
+
+// FailurePolicy selects what happens to requests when the store or the semaphore of a limiter fails.
+type FailurePolicy int
+
+const (
+	// FailOpen lets requests through. This is the default.
+	FailOpen FailurePolicy = iota
+
+	// FailClosed rejects requests, asking clients to retry after BreakerCooldown.
+	FailClosed
+
+	// FailLocal limits requests with an in-memory store and semaphore of the process,
+	// every process then enforces the limits alone.
+	FailLocal
+)
+
+var failurePolicyNames = map[FailurePolicy]string{
+	FailOpen:   "allow",
+	FailClosed: "deny",
+	FailLocal:  "local",
+}
+
+// String returns the name of the policy as accepted by ParseFailurePolicy.
+func (p FailurePolicy) String() string {
+	if name, found := failurePolicyNames[p]; found {
+		return name
+	}
+	return fmt.Sprintf("FailurePolicy(%d)", int(p))
+}
+
+// ParseFailurePolicy returns the failure policy of the given name: "allow", "deny" or "local".
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	for policy, policyName := range failurePolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown failure policy %q", name)
+}
+
+// ErrCircuitOpen is returned instead of calling the store while the circuit breaker of a limiter is open.
+// It is reported once to OnError when the breaker opens.
+var ErrCircuitOpen = errors.New("rate-limit store circuit breaker is open")
+
+// StoreError is an error of the store or the semaphore of a limiter, reported to OnError.
+type StoreError struct {
+	// Failed operation: "take", "refund", "peek", "acquire" or "release".
+	Op string
+
+	// Key of the bucket or semaphore.
+	Key string
+
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return "fail to " + e.Op + " rate limit " + e.Key + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the store.
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// breaker counts the consecutive failures of the store. Once open, it lets a single call through
+// every cooldown to probe the store, and closes when the probe succeeds.
+type breaker struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether the store can be called.
+func (b *breaker) allow(threshold int, cooldown time.Duration, now time.Time) bool {
+	if threshold <= 0 {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < threshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(cooldown)
+	return true
+}
+
+// record counts the outcome of a store call and reports whether it opened the breaker.
+func (b *breaker) record(err error, threshold int, cooldown time.Duration, now time.Time) bool {
+	if threshold <= 0 {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures == threshold {
+		b.openUntil = now.Add(cooldown)
+		return true
+	}
+	return false
+}
+
+// call runs fn against the store or the semaphore with a context canceled after Timeout,
+// unless the circuit breaker is open, and reports its error to OnError.
+// Calls given up by the caller, whose ctx is done, are not counted by the breaker.
+func (l *Limiter) call(ctx context.Context, op string, key string, fn func(ctx context.Context) error) error {
+	if !l.breaker.allow(l.BreakerThreshold, l.BreakerCooldown, time.Now()) {
+		return ErrCircuitOpen
+	}
+
+	callCtx, cancel := l.storeContext(ctx)
+	err := fn(callCtx)
+	cancel()
+
+	if ctx.Err() == nil && l.breaker.record(err, l.BreakerThreshold, l.BreakerCooldown, time.Now()) {
+		defer l.reportError(ErrCircuitOpen)
+	}
+	if err != nil {
+		err = &StoreError{Op: op, Key: key, Err: err}
+		l.reportError(err)
+	}
+	return err
+}
+
+// storeContext returns the context of a store call, canceled after Timeout.
+func (l *Limiter) storeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.Timeout > 0 {
+		return context.WithTimeout(ctx, l.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// reportError calls OnError with err, or logs it.
+func (l *Limiter) reportError(err error) {
+	if l.OnError != nil {
+		l.OnError(err)
+		return
+	}
+	log.Println(err)
+}
+
+// local returns the in-memory store and semaphore used by FailLocal, created on first use.
+func (l *Limiter) local() (*store.Memory, *store.LocalSemaphore) {
+	l.localOnce.Do(func() {
+		l.localStore = store.NewMemory()
+		l.localSemaphore = store.NewLocalSemaphore()
+	})
+	return l.localStore, l.localSemaphore
+}
+
+// failureStates returns the states of buckets whose store failed, according to FailurePolicy.
+// With FailLocal, n tokens are taken from all of them in the local store, or from none, and they are local.
+func (l *Limiter) failureStates(ctx context.Context, buckets []bucket, n int64) []store.State {
+	if l.FailurePolicy == FailLocal {
+		localStore, _ := l.local()
+		keys, limits := bucketArgs(buckets)
+		states, _ := localStore.TakeAll(ctx, keys, limits, n)
+		for i := range buckets {
+			buckets[i].local = true
+		}
+		return states
+	}
+
+	states := make([]store.State, len(buckets))
+	for i, b := range buckets {
+		states[i], _ = l.failureState(ctx, b.key, b.limit, n)
+	}
+	return states
+}
+
+// failureState returns the state of a bucket limited by limit whose store failed, according to FailurePolicy.
+// With FailLocal, n tokens are taken from the local store, and local is true.
+func (l *Limiter) failureState(ctx context.Context, key string, limit store.Limit, n int64) (state store.State, local bool) {
+	now := time.Now()
+	switch l.FailurePolicy {
+	case FailClosed:
+		return store.State{ResetAt: now.Add(l.BreakerCooldown), RetryAfter: l.BreakerCooldown}, false
+	case FailLocal:
+		localStore, _ := l.local()
+		state, _ = localStore.Take(ctx, key, limit, n)
+		return state, true
+	default:
+		return store.State{Allowed: true, Remaining: limit.Max, ResetAt: now}, false
+	}
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aw16com/tollbooth/store"
+)
+
+var errUnavailable = errors.New("store is unavailable")
+
+// failingStore fails every call, like an unreachable redis, and counts them.
+type failingStore struct {
+	sync.Mutex
+	calls int
+}
+
+func (s *failingStore) Take(ctx context.Context, key string, limit store.Limit, n int64) (store.State, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.calls++
+	return store.State{}, errUnavailable
+}
+
+func (s *failingStore) Peek(ctx context.Context, key string, limit store.Limit) (store.State, error) {
+	return s.Take(ctx, key, limit, 1)
+}
+
+func (s *failingStore) Reset(ctx context.Context, key string) error {
+	_, err := s.Take(ctx, key, store.Limit{}, 1)
+	return err
+}
+
+func (s *failingStore) Acquire(ctx context.Context, key string, max int64, ttl time.Duration) (store.Lease, error) {
+	_, err := s.Take(ctx, key, store.Limit{}, 1)
+	return store.Lease{}, err
+}
+
+func (s *failingStore) Release(ctx context.Context, lease store.Lease) error {
+	_, err := s.Take(ctx, lease.Key, store.Limit{}, 1)
+	return err
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	for _, policy := range []FailurePolicy{FailOpen, FailClosed, FailLocal} {
+		if parsed, err := ParseFailurePolicy(policy.String()); err != nil || parsed != policy {
+			t.Errorf("Policy %v should be parsed back. Parsed: %v, Error: %v", policy, parsed, err)
+		}
+	}
+	if _, err := ParseFailurePolicy("retry"); err == nil {
+		t.Error("Unknown policy should not be parsed.")
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	cases := map[FailurePolicy][]bool{
+		FailOpen:   {true, true},
+		FailClosed: {false, false},
+		FailLocal:  {true, false},
+	}
+
+	for policy, expected := range cases {
+		limiter := NewLimiterWithStore(1, time.Minute, &failingStore{})
+		limiter.FailurePolicy = policy
+		var reported []error
+		limiter.OnError = func(err error) { reported = append(reported, err) }
+
+		for i, allowed := range expected {
+			result := limiter.Allow("TestFailurePolicy", nil)
+			if result.Allowed != allowed {
+				t.Errorf("Request %d should be allowed: %v with policy %v. Result: %+v", i, allowed, policy, result)
+			}
+			if !errors.Is(result.Err, errUnavailable) {
+				t.Errorf("Result should report the error of the store with policy %v. Error: %v", policy, result.Err)
+			}
+		}
+
+		var storeError *StoreError
+		if len(reported) != 2 || !errors.As(reported[0], &storeError) || storeError.Op != "take" || storeError.Key != "TestFailurePolicy" {
+			t.Errorf("Errors of the store should be reported with policy %v. Errors: %v", policy, reported)
+		}
+		limiter.Close()
+	}
+}
+
+func TestFailurePolicyQuota(t *testing.T) {
+	limiter := NewLimiterWithStore(10, time.Minute, &failingStore{})
+	limiter.FailurePolicy = FailLocal
+	limiter.OnError = func(err error) {}
+	limiter.Quotas = []Quota{{Max: 1, Period: Daily}}
+	defer limiter.Close()
+
+	if result := limiter.Allow("TestFailurePolicyQuota", nil); !result.Allowed {
+		t.Errorf("First request should be counted by the local quota. Result: %+v", result)
+	}
+	if result := limiter.Allow("TestFailurePolicyQuota", nil); result.Allowed || result.Quota == nil {
+		t.Errorf("Second request should exceed the local quota. Result: %+v", result)
+	}
+	local, _ := limiter.local()
+	if state, _ := local.Peek(context.Background(), "TestFailurePolicyQuota", store.Limit{Max: 10, TTL: time.Minute}); state.Remaining != 9 {
+		t.Errorf("Rejected request should be refunded to the local rate limit. State: %+v", state)
+	}
+}
+
+func TestFailurePolicyInFlight(t *testing.T) {
+	cases := map[FailurePolicy][]bool{
+		FailOpen:   {true, true},
+		FailClosed: {false, false},
+		FailLocal:  {true, false},
+	}
+
+	for policy, expected := range cases {
+		limiter := NewLimiterWithStore(1, time.Minute, store.NewMemory())
+		limiter.Semaphore = &failingStore{}
+		limiter.MaxInFlight = 1
+		limiter.FailurePolicy = policy
+		limiter.OnError = func(err error) {}
+
+		for i, acquired := range expected {
+			release, rejected := limiter.AcquireInFlight("TestFailurePolicyInFlight", nil)
+			if (rejected == nil) != acquired {
+				t.Errorf("Slot %d should be acquired: %v with policy %v. Rejection: %+v", i, acquired, policy, rejected)
+			}
+			if rejected != nil && !errors.Is(rejected.Err, errUnavailable) {
+				t.Errorf("Rejection should report the error of the semaphore with policy %v. Error: %v", policy, rejected.Err)
+			}
+			if policy == FailOpen {
+				release()
+			}
+		}
+		limiter.Close()
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := &failingStore{}
+	limiter := NewLimiterWithStore(1, time.Minute, failing)
+	limiter.BreakerThreshold = 3
+	limiter.BreakerCooldown = 50 * time.Millisecond
+	var reported []error
+	limiter.OnError = func(err error) { reported = append(reported, err) }
+
+	for i := 0; i < 10; i++ {
+		limiter.Allow("TestCircuitBreaker", nil)
+	}
+	if failing.calls != 3 {
+		t.Errorf("Store should not be called once the breaker is open. Calls: %v", failing.calls)
+	}
+	if len(reported) != 4 || reported[3] != ErrCircuitOpen {
+		t.Errorf("Opening of the breaker should be reported once. Errors: %v", reported)
+	}
+	if result := limiter.Allow("TestCircuitBreaker", nil); result.Err != ErrCircuitOpen || !result.Allowed {
+		t.Errorf("Requests should be let through while the breaker is open. Result: %+v", result)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	limiter.Allow("TestCircuitBreaker", nil)
+	limiter.Allow("TestCircuitBreaker", nil)
+	if failing.calls != 4 {
+		t.Errorf("Store should be probed once after the cooldown. Calls: %v", failing.calls)
+	}
+
+	limiter.Store = store.NewMemory()
+	time.Sleep(60 * time.Millisecond)
+	if result := limiter.Allow("TestCircuitBreaker", nil); result.Err != nil {
+		t.Errorf("Successful probe should close the breaker. Result: %+v", result)
+	}
+	if result := limiter.Allow("TestCircuitBreaker", nil); result.Err != nil || result.Allowed {
+		t.Errorf("Store should be called again once the breaker is closed. Result: %+v", result)
+	}
+}
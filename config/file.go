@@ -0,0 +1,753 @@
+package config
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	rate "github.com/aw16com/rate/redis"
+	"github.com/aw16com/tollbooth/store"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// FileConfig is the declarative configuration of limiters, written in YAML or JSON.
+type FileConfig struct {
+	Limiters []LimiterConfig `yaml:"limiters"`
+}
+
+// LimiterConfig is the declarative configuration of a Limiter and its API rate limits.
+// Unset fields keep the defaults of NewLimiter.
+type LimiterConfig struct {
+	// Name identifying the limiter, required and unique.
+	Name string `yaml:"name"`
+
+	Max                int64         `yaml:"max"`
+	TTL                time.Duration `yaml:"ttl"`
+	Message            string        `yaml:"message"`
+	MessageContentType string        `yaml:"message_content_type"`
+	StatusCode         int           `yaml:"status_code"`
+	IPLookups          []string      `yaml:"ip_lookups"`
+	Methods            []string      `yaml:"methods"`
+	Headers            []string      `yaml:"headers"`
+	BasicAuthUsers     []string      `yaml:"basic_auth_users"`
+
+	// Parts of the request keys in order, replacing the default keys made of the IP, path, methods,
+	// headers and basic auth users: "ip", "path", "route", "method", "host", "basic_auth_user",
+	// "header:<name>", "query:<name>", "cookie:<name>", "api_key", "api_key:<name>", "bearer_token",
+	// "claim:<name>", or "hash:" followed by one of them to store its SHA-256. "ip", "method" and
+	// "basic_auth_user" use ip_lookups, methods and basic_auth_users when set, "claim" uses jwt.
+	Keys []string `yaml:"keys"`
+
+	// Bucket of the requests without keys, which are not limited when empty.
+	AnonymousKey string `yaml:"anonymous_key"`
+
+	// Response header styles among "legacy", "x-ratelimit" and "ietf".
+	ResponseHeaders []string `yaml:"response_headers"`
+
+	// "token_bucket", "sliding_window_log", "sliding_window_counter", "gcra" or "fixed_window".
+	// Default is "token_bucket".
+	Algorithm string `yaml:"algorithm"`
+
+	// Wait mode settings, see Limiter.Wait.
+	MaxWait  time.Duration `yaml:"max_wait"`
+	MaxQueue int64         `yaml:"max_queue"`
+
+	// Maximum number of requests of a key handled at once, and lifetime of their slots.
+	MaxInFlight int64         `yaml:"max_in_flight"`
+	InFlightTTL time.Duration `yaml:"in_flight_ttl"`
+
+	// Maximum duration of every call to the store, see Limiter.Timeout.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// "allow", "deny" or "local", see FailurePolicy. Default is "allow".
+	FailurePolicy string `yaml:"failure_policy"`
+
+	// Circuit breaker settings, see Limiter.BreakerThreshold.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+
+	// Verifier of the bearer tokens of "claim:<name>" keys and tiers. Without it, only the claims
+	// set in the request contexts with WithClaims are used.
+	JWT *JWTConfig `yaml:"jwt"`
+
+	// Limits selected by a claim of the requests, see Tiers.
+	Tiers *TiersConfig `yaml:"tiers"`
+
+	Quotas []QuotaConfig `yaml:"quotas"`
+	Store  StoreConfig   `yaml:"store"`
+	Rules  []RuleConfig  `yaml:"rules"`
+}
+
+// JWTConfig is the declarative configuration of a JWTVerifier.
+// The key of id "" verifies the tokens without key id, or with an unknown one.
+type JWTConfig struct {
+	// HS256 secrets by key id, at least MinSecretLength bytes long.
+	Secrets map[string]string `yaml:"secrets"`
+
+	// PEM encoded RS256 and ES256 public keys by key id.
+	PublicKeys map[string]string `yaml:"public_keys"`
+
+	Leeway   time.Duration `yaml:"leeway"`
+	Issuer   string        `yaml:"issuer"`
+	Audience string        `yaml:"audience"`
+}
+
+// TiersConfig is the declarative configuration of Tiers.
+type TiersConfig struct {
+	// Name of the claim selecting the tier, such as "plan".
+	Claim string `yaml:"claim"`
+
+	// Limits by claim value.
+	Limits map[string]LimitConfig `yaml:"limits"`
+
+	// Limit of the requests without the claim or with an unknown value, the limiter's when unset.
+	Default *LimitConfig `yaml:"default"`
+}
+
+// QuotaConfig is the declarative configuration of a Quota.
+type QuotaConfig struct {
+	Max int64 `yaml:"max"`
+
+	// "hourly", "daily", "weekly" or "monthly".
+	Period string `yaml:"period"`
+
+	// IANA time zone of the period boundaries, such as "Europe/Paris". Default is UTC.
+	TimeZone string `yaml:"time_zone"`
+}
+
+// StoreConfig selects the backend keeping the token buckets of a limiter.
+type StoreConfig struct {
+	// "memory" or "redis". Default is "memory".
+	Type string `yaml:"type"`
+
+	Redis  *rate.ConfigRedis  `yaml:"redis"`
+	Memory *MemoryStoreConfig `yaml:"memory"`
+
+	// Serves tokens leased by batches from the store when set.
+	Leasing *LeasingStoreConfig `yaml:"leasing"`
+}
+
+// MemoryStoreConfig is the declarative form of store.MemoryConfig.
+type MemoryStoreConfig struct {
+	MaxKeys         int           `yaml:"max_keys"`
+	IdleTTL         time.Duration `yaml:"idle_ttl"`
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+	Shards          int           `yaml:"shards"`
+}
+
+// LeasingStoreConfig is the declarative form of store.LeasingConfig.
+type LeasingStoreConfig struct {
+	BatchSize int64         `yaml:"batch_size"`
+	LeaseTTL  time.Duration `yaml:"lease_ttl"`
+}
+
+// RuleConfig is the declarative configuration of an API rate limit.
+type RuleConfig struct {
+	Path   string `yaml:"path"`
+	Method string `yaml:"method"`
+
+	// "regexp", "exact", "prefix" or "template". Default is "regexp".
+	Match string `yaml:"match"`
+
+	Priority int           `yaml:"priority"`
+	Max      int64         `yaml:"max"`
+	TTL      time.Duration `yaml:"ttl"`
+
+	// Algorithm of the rule, the limiter's when empty.
+	Algorithm string `yaml:"algorithm"`
+
+	// Tokens taken by each request. Default is 1.
+	Cost int64 `yaml:"cost"`
+
+	MaxInFlight int64 `yaml:"max_in_flight"`
+
+	// Additional limits enforced on the same requests.
+	Limits []LimitConfig `yaml:"limits"`
+}
+
+// LimitConfig is the declarative configuration of an additional limit of a rule.
+type LimitConfig struct {
+	Max       int64         `yaml:"max"`
+	TTL       time.Duration `yaml:"ttl"`
+	Algorithm string        `yaml:"algorithm"`
+}
+
+// ConfigError lists the problems of a configuration file, each prefixed by its line.
+type ConfigError struct {
+	Errors []string
+}
+
+// Error returns every problem on its own line.
+func (e *ConfigError) Error() string {
+	return "invalid rate-limit config:\n  " + strings.Join(e.Errors, "\n  ")
+}
+
+var (
+	headerStyles = map[string]HeaderStyle{
+		"legacy":      LegacyHeaders,
+		"x-ratelimit": XRateLimitHeaders,
+		"ietf":        IETFHeaders,
+	}
+
+	matchTypes = map[string]MatchType{
+		"":         MatchRegexp,
+		"regexp":   MatchRegexp,
+		"exact":    MatchExact,
+		"prefix":   MatchPrefix,
+		"template": MatchTemplate,
+	}
+)
+
+// LoadConfigFile reads and validates the YAML or JSON configuration file at path.
+func LoadConfigFile(path string) (*FileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig decodes and validates a YAML or JSON configuration.
+// Unknown fields are rejected, errors are reported with their line numbers.
+func ParseConfig(data []byte) (*FileConfig, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &ConfigError{Errors: []string{strings.TrimPrefix(err.Error(), "yaml: ")}}
+	}
+
+	conf := &FileConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(conf); err != nil {
+		if typeError, ok := err.(*yaml.TypeError); ok {
+			return nil, &ConfigError{Errors: typeError.Errors}
+		}
+		if len(root.Content) > 0 {
+			return nil, &ConfigError{Errors: []string{strings.TrimPrefix(err.Error(), "yaml: ")}}
+		}
+	}
+
+	if errs := conf.validate(&root); len(errs) > 0 {
+		return nil, &ConfigError{Errors: errs}
+	}
+	return conf, nil
+}
+
+// NewLimiters builds the limiters of the configuration by name.
+func (c *FileConfig) NewLimiters() map[string]*Limiter {
+	limiters := make(map[string]*Limiter, len(c.Limiters))
+	for i := range c.Limiters {
+		limiters[c.Limiters[i].Name] = c.Limiters[i].NewLimiter()
+	}
+	return limiters
+}
+
+// NewLimiter builds the configured Limiter with its store and API rate limits.
+// The configuration must have been validated by ParseConfig.
+func (c *LimiterConfig) NewLimiter() *Limiter {
+	limiter := NewLimiterWithStore(c.Max, c.TTL, c.Store.newStore())
+	c.apply(limiter)
+	return limiter
+}
+
+// RateLimits returns the configured API rate limits.
+func (c *LimiterConfig) RateLimits() []RateLimit {
+	rules := make([]RateLimit, 0, len(c.Rules))
+	for _, rule := range c.Rules {
+		algorithm, _ := algorithmOf(rule.Algorithm)
+		var limits []LimitValue
+		for _, limit := range rule.Limits {
+			limits = append(limits, limit.limitValue())
+		}
+
+		rules = append(rules, RateLimit{
+			Key:         LimitKey{Path: rule.Path, Method: rule.Method, Match: matchTypes[rule.Match]},
+			Val:         LimitValue{Max: rule.Max, TTL: rule.TTL, Algorithm: algorithm},
+			Limits:      limits,
+			Priority:    rule.Priority,
+			Cost:        rule.Cost,
+			MaxInFlight: rule.MaxInFlight,
+		})
+	}
+	return rules
+}
+
+// quotas returns the configured quotas.
+func (c *LimiterConfig) quotas() []Quota {
+	var quotas []Quota
+	for _, quota := range c.Quotas {
+		period, _ := ParsePeriod(quota.Period)
+		location, _ := time.LoadLocation(quota.TimeZone)
+		quotas = append(quotas, Quota{Max: quota.Max, Period: period, Location: location})
+	}
+	return quotas
+}
+
+// apply sets the configured fields and API rate limits of limiter.
+func (c *LimiterConfig) apply(limiter *Limiter) {
+	limiter.Max = c.Max
+	limiter.TTL = c.TTL
+	limiter.Algorithm, _ = algorithmOf(c.Algorithm)
+	limiter.Quotas = c.quotas()
+	limiter.MaxWait = c.MaxWait
+	limiter.MaxQueue = c.MaxQueue
+	limiter.MaxInFlight = c.MaxInFlight
+	limiter.Timeout = c.Timeout
+	limiter.FailurePolicy, _ = failurePolicyOf(c.FailurePolicy)
+	limiter.BreakerThreshold = c.BreakerThreshold
+	if c.BreakerCooldown != 0 {
+		limiter.BreakerCooldown = c.BreakerCooldown
+	}
+	if c.InFlightTTL != 0 {
+		limiter.InFlightTTL = c.InFlightTTL
+	}
+	if c.Message != "" {
+		limiter.Message = c.Message
+	}
+	if c.MessageContentType != "" {
+		limiter.MessageContentType = c.MessageContentType
+	}
+	if c.StatusCode != 0 {
+		limiter.StatusCode = c.StatusCode
+	}
+	if c.IPLookups != nil {
+		limiter.IPLookups = c.IPLookups
+	}
+	limiter.Methods = c.Methods
+	limiter.Headers = c.Headers
+	limiter.BasicAuthUsers = c.BasicAuthUsers
+	verifier := c.JWT.newVerifier()
+	if c.Keys != nil {
+		limiter.KeyFunc, _ = keyFuncOf(c.Keys, limiter, verifier)
+	}
+	if c.AnonymousKey != "" {
+		keys := limiter.KeyFunc
+		if keys == nil {
+			keys = limiter.defaultKeys
+		}
+		limiter.KeyFunc = Fallback(keys, Constant(c.AnonymousKey))
+	}
+	if c.Tiers != nil {
+		limiter.LimitFunc = c.Tiers.newTiers(verifier).Limit
+	}
+	if c.ResponseHeaders != nil {
+		limiter.HeaderStyle = 0
+		for _, style := range c.ResponseHeaders {
+			limiter.HeaderStyle |= headerStyles[style]
+		}
+	}
+
+	if err := limiter.Rules.Replace(c.RateLimits()); err != nil {
+		log.Println("fail to register rate limits: ", err)
+	}
+}
+
+// newVerifier returns the configured JWTVerifier, nil when c is nil.
+// The configuration must have been validated by ParseConfig.
+func (c *JWTConfig) newVerifier() *JWTVerifier {
+	if c == nil {
+		return nil
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(c.Secrets)+len(c.PublicKeys))
+	for id, secret := range c.Secrets {
+		keys[id] = []byte(secret)
+	}
+	for id, data := range c.PublicKeys {
+		keys[id], _ = ParsePublicKey([]byte(data))
+	}
+
+	verifier := NewJWTVerifier(keys)
+	verifier.Leeway = c.Leeway
+	verifier.Issuer = c.Issuer
+	verifier.Audience = c.Audience
+	return verifier
+}
+
+// newTiers returns the configured Tiers verifying bearer tokens with verifier.
+func (c *TiersConfig) newTiers(verifier *JWTVerifier) *Tiers {
+	tiers := &Tiers{Verifier: verifier, Claim: c.Claim, Limits: make(map[string]LimitValue, len(c.Limits))}
+	for value, limit := range c.Limits {
+		tiers.Limits[value] = limit.limitValue()
+	}
+	if c.Default != nil {
+		limit := c.Default.limitValue()
+		tiers.Default = &limit
+	}
+	return tiers
+}
+
+// limitValue returns the configured LimitValue.
+func (c LimitConfig) limitValue() LimitValue {
+	algorithm, _ := algorithmOf(c.Algorithm)
+	return LimitValue{Max: c.Max, TTL: c.TTL, Algorithm: algorithm}
+}
+
+func (c *StoreConfig) newStore() store.Store {
+	s := c.newBackend()
+	if c.Leasing == nil {
+		return s
+	}
+	return store.NewLeasingWithConfig(s, store.LeasingConfig{
+		BatchSize: c.Leasing.BatchSize,
+		LeaseTTL:  c.Leasing.LeaseTTL,
+	})
+}
+
+// newBackend returns the store of the configured type.
+func (c *StoreConfig) newBackend() store.Store {
+	if c.Type == "redis" {
+		redisStore, err := store.NewRedisFromConfig(c.Redis)
+		if err != nil {
+			log.Println("fail to set rate limiter's redis: ", err)
+		}
+		return redisStore
+	}
+
+	if c.Memory == nil {
+		return store.NewMemory()
+	}
+	return store.NewMemoryWithConfig(store.MemoryConfig{
+		MaxKeys:         c.Memory.MaxKeys,
+		IdleTTL:         c.Memory.IdleTTL,
+		CleanupInterval: c.Memory.CleanupInterval,
+		Shards:          c.Memory.Shards,
+	})
+}
+
+// algorithmOf returns the algorithm of the given name, zero when name is empty.
+func algorithmOf(name string) (store.Algorithm, error) {
+	if name == "" {
+		return 0, nil
+	}
+	return store.ParseAlgorithm(name)
+}
+
+// keyFuncOf returns the KeyFunc combining the key parts of the given names for limiter,
+// verifying bearer tokens with verifier.
+func keyFuncOf(names []string, limiter *Limiter, verifier *JWTVerifier) (KeyFunc, error) {
+	extractors := make([]KeyFunc, 0, len(names))
+	for _, name := range names {
+		extractor, err := keyOf(name, limiter, verifier)
+		if err != nil {
+			return nil, err
+		}
+		extractors = append(extractors, extractor)
+	}
+	return Keys(extractors...), nil
+}
+
+// keyOf returns the extractor of the key part of the given name for limiter, verifying bearer tokens with verifier.
+func keyOf(name string, limiter *Limiter, verifier *JWTVerifier) (KeyFunc, error) {
+	kind, field := name, ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		kind, field = name[:i], name[i+1:]
+	}
+
+	switch {
+	case name == "ip":
+		return IP(limiter.IPLookups...), nil
+	case name == "path":
+		return Path(), nil
+	case name == "route":
+		return Route(limiter.Rules), nil
+	case name == "method":
+		return Method(limiter.Methods...), nil
+	case name == "host":
+		return Host(), nil
+	case name == "basic_auth_user":
+		return BasicAuthUser(limiter.BasicAuthUsers...), nil
+	case name == "api_key":
+		return APIKey(), nil
+	case name == "bearer_token":
+		return BearerToken(), nil
+	case kind == "hash" && field != "":
+		extractor, err := keyOf(field, limiter, verifier)
+		if err != nil {
+			return nil, err
+		}
+		return Hashed(extractor), nil
+	case field == "":
+		return nil, fmt.Errorf("unknown key %q", name)
+	case kind == "api_key":
+		return APIKey(field), nil
+	case kind == "header":
+		return Header(field), nil
+	case kind == "query":
+		return Query(field), nil
+	case kind == "cookie":
+		return Cookie(field), nil
+	case kind == "claim":
+		return Claim(verifier, field), nil
+	default:
+		return nil, fmt.Errorf("unknown key %q", name)
+	}
+}
+
+// failurePolicyOf returns the failure policy of the given name, FailOpen when it is empty.
+func failurePolicyOf(name string) (FailurePolicy, error) {
+	if name == "" {
+		return FailOpen, nil
+	}
+	return ParseFailurePolicy(name)
+}
+
+// validate returns the problems of the configuration, located in root.
+func (c *FileConfig) validate(root *yaml.Node) []string {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	names := make(map[string]bool)
+	for i, l := range c.Limiters {
+		at := func(path ...interface{}) int {
+			return lineOf(root, append([]interface{}{"limiters", i}, path...)...)
+		}
+
+		switch {
+		case l.Name == "":
+			fail("line %d: limiter name is required", at())
+		case names[l.Name]:
+			fail("line %d: limiter name %q is duplicated", at("name"), l.Name)
+		}
+		names[l.Name] = true
+
+		if l.Max < 1 {
+			fail("line %d: max of limiter %q must be positive", at("max"), l.Name)
+		}
+		if l.TTL <= 0 {
+			fail("line %d: ttl of limiter %q must be positive", at("ttl"), l.Name)
+		}
+		if l.StatusCode != 0 && (l.StatusCode < 100 || l.StatusCode > 599) {
+			fail("line %d: status_code %d of limiter %q is not an HTTP status code", at("status_code"), l.StatusCode, l.Name)
+		}
+		for j, name := range l.Keys {
+			if _, err := keyOf(name, &Limiter{}, nil); err != nil {
+				fail("line %d: %v of limiter %q", at("keys", j), err, l.Name)
+			}
+		}
+		for j, style := range l.ResponseHeaders {
+			if _, found := headerStyles[style]; !found {
+				fail("line %d: unknown response_headers %q of limiter %q", at("response_headers", j), style, l.Name)
+			}
+		}
+
+		if _, err := algorithmOf(l.Algorithm); err != nil {
+			fail("line %d: %v of limiter %q", at("algorithm"), err, l.Name)
+		}
+
+		if _, err := failurePolicyOf(l.FailurePolicy); err != nil {
+			fail("line %d: %v of limiter %q", at("failure_policy"), err, l.Name)
+		}
+		if l.BreakerThreshold < 0 || l.BreakerCooldown < 0 {
+			fail("line %d: circuit breaker settings of limiter %q must not be negative", at("breaker_threshold"), l.Name)
+		}
+		if l.Timeout < 0 {
+			fail("line %d: timeout of limiter %q must not be negative", at("timeout"), l.Name)
+		}
+		if l.MaxWait < 0 {
+			fail("line %d: max_wait of limiter %q must not be negative", at("max_wait"), l.Name)
+		}
+		if l.MaxQueue < 0 {
+			fail("line %d: max_queue of limiter %q must not be negative", at("max_queue"), l.Name)
+		}
+		if l.MaxInFlight < 0 {
+			fail("line %d: max_in_flight of limiter %q must not be negative", at("max_in_flight"), l.Name)
+		}
+		if l.InFlightTTL < 0 {
+			fail("line %d: in_flight_ttl of limiter %q must not be negative", at("in_flight_ttl"), l.Name)
+		}
+
+		if jwt := l.JWT; jwt != nil {
+			if len(jwt.Secrets)+len(jwt.PublicKeys) == 0 {
+				fail("line %d: jwt of limiter %q requires secrets or public_keys", at("jwt"), l.Name)
+			}
+			// Keys are sorted so that problems are reported in a stable order.
+			ids := make([]string, 0, len(jwt.Secrets))
+			for id := range jwt.Secrets {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				if len(jwt.Secrets[id]) < MinSecretLength {
+					fail("line %d: jwt secret %q of limiter %q must be at least %d bytes long", at("jwt", "secrets", id), id, l.Name, MinSecretLength)
+				}
+			}
+
+			ids = make([]string, 0, len(jwt.PublicKeys))
+			for id := range jwt.PublicKeys {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				data := jwt.PublicKeys[id]
+				if _, found := jwt.Secrets[id]; found {
+					fail("line %d: jwt key %q of limiter %q is both a secret and a public key", at("jwt", "public_keys", id), id, l.Name)
+				}
+				if _, err := ParsePublicKey([]byte(data)); err != nil {
+					fail("line %d: invalid jwt public key %q of limiter %q: %v", at("jwt", "public_keys", id), id, l.Name, err)
+				}
+			}
+			if jwt.Leeway < 0 {
+				fail("line %d: jwt leeway of limiter %q must not be negative", at("jwt", "leeway"), l.Name)
+			}
+		}
+
+		if tiers := l.Tiers; tiers != nil {
+			if tiers.Claim == "" {
+				fail("line %d: tiers claim of limiter %q is required", at("tiers"), l.Name)
+			}
+			validateLimit := func(limit LimitConfig, path ...interface{}) {
+				tierAt := func(field string) int {
+					return at(append(append([]interface{}{"tiers"}, path...), field)...)
+				}
+				if limit.Max < 1 {
+					fail("line %d: max of tier of limiter %q must be positive", tierAt("max"), l.Name)
+				}
+				if limit.TTL <= 0 {
+					fail("line %d: ttl of tier of limiter %q must be positive", tierAt("ttl"), l.Name)
+				}
+				if _, err := algorithmOf(limit.Algorithm); err != nil {
+					fail("line %d: %v of tier of limiter %q", tierAt("algorithm"), err, l.Name)
+				}
+			}
+			values := make([]string, 0, len(tiers.Limits))
+			for value := range tiers.Limits {
+				values = append(values, value)
+			}
+			sort.Strings(values)
+			for _, value := range values {
+				validateLimit(tiers.Limits[value], "limits", value)
+			}
+			if tiers.Default != nil {
+				validateLimit(*tiers.Default, "default")
+			}
+		}
+
+		for j, quota := range l.Quotas {
+			if quota.Max < 1 {
+				fail("line %d: max of quota of limiter %q must be positive", at("quotas", j, "max"), l.Name)
+			}
+			if _, err := ParsePeriod(quota.Period); err != nil {
+				fail("line %d: %v of limiter %q", at("quotas", j, "period"), err, l.Name)
+			}
+			if _, err := time.LoadLocation(quota.TimeZone); err != nil {
+				fail("line %d: unknown time_zone %q of limiter %q", at("quotas", j, "time_zone"), quota.TimeZone, l.Name)
+			}
+		}
+
+		switch l.Store.Type {
+		case "", "memory":
+			if l.Store.Redis != nil {
+				fail("line %d: redis settings of limiter %q require store type redis", at("store", "redis"), l.Name)
+			}
+		case "redis":
+			if l.Store.Redis == nil || l.Store.Redis.Host == "" {
+				fail("line %d: redis store of limiter %q requires a host", at("store"), l.Name)
+			}
+			if l.Store.Memory != nil {
+				fail("line %d: memory settings of limiter %q require store type memory", at("store", "memory"), l.Name)
+			}
+		default:
+			fail("line %d: unknown store type %q of limiter %q", at("store", "type"), l.Store.Type, l.Name)
+		}
+		if leasing := l.Store.Leasing; leasing != nil && (leasing.BatchSize < 0 || leasing.LeaseTTL < 0) {
+			fail("line %d: leasing settings of limiter %q must not be negative", at("store", "leasing"), l.Name)
+		}
+
+		rules := make(map[LimitKey]bool)
+		for j, rule := range l.Rules {
+			ruleAt := func(path ...interface{}) int {
+				return at(append([]interface{}{"rules", j}, path...)...)
+			}
+
+			match, found := matchTypes[rule.Match]
+			switch {
+			case rule.Path == "":
+				fail("line %d: rule path of limiter %q is required", ruleAt(), l.Name)
+			case !found:
+				fail("line %d: unknown match %q of rule %q", ruleAt("match"), rule.Match, rule.Path)
+			case match == MatchRegexp:
+				if _, err := regexp.Compile(rule.Path); err != nil {
+					fail("line %d: invalid path of rule %q: %v", ruleAt("path"), rule.Path, err)
+				}
+			}
+			key := LimitKey{Path: rule.Path, Method: rule.Method, Match: match}
+			if key.Method == "" {
+				key.Method = anyMethod
+			}
+			if rule.Path != "" && found && rules[key] {
+				fail("line %d: rule %q of limiter %q is duplicated", ruleAt(), rule.Path, l.Name)
+			}
+			rules[key] = true
+			if rule.Max < 1 {
+				fail("line %d: max of rule %q must be positive", ruleAt("max"), rule.Path)
+			}
+			if rule.TTL <= 0 {
+				fail("line %d: ttl of rule %q must be positive", ruleAt("ttl"), rule.Path)
+			}
+			if _, err := algorithmOf(rule.Algorithm); err != nil {
+				fail("line %d: %v of rule %q", ruleAt("algorithm"), err, rule.Path)
+			}
+			if rule.Cost < 0 {
+				fail("line %d: cost of rule %q must not be negative", ruleAt("cost"), rule.Path)
+			}
+			if rule.MaxInFlight < 0 {
+				fail("line %d: max_in_flight of rule %q must not be negative", ruleAt("max_in_flight"), rule.Path)
+			}
+			for k, limit := range rule.Limits {
+				if limit.Max < 1 {
+					fail("line %d: max of limit of rule %q must be positive", ruleAt("limits", k, "max"), rule.Path)
+				}
+				if limit.TTL <= 0 {
+					fail("line %d: ttl of limit of rule %q must be positive", ruleAt("limits", k, "ttl"), rule.Path)
+				}
+				if _, err := algorithmOf(limit.Algorithm); err != nil {
+					fail("line %d: %v of limit of rule %q", ruleAt("limits", k, "algorithm"), err, rule.Path)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// lineOf returns the line of the node found by following path, made of mapping keys and
+// sequence indexes, from root. The line of the deepest node found is returned.
+func lineOf(root *yaml.Node, path ...interface{}) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	for _, step := range path {
+		next := (*yaml.Node)(nil)
+		switch step := step.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == step {
+						next = node.Content[i+1]
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && step < len(node.Content) {
+				next = node.Content[step]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+
+	return node.Line
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aw16com/tollbooth/store"
+)
+
+const testConfigYAML = `
+limiters:
+  - name: api
+    max: 10
+    ttl: 100ms
+    message: Slow down.
+    ip_lookups: [X-Forwarded-For, RemoteAddr]
+    methods: [GET, POST]
+    response_headers: [x-ratelimit, ietf]
+    algorithm: sliding_window_counter
+    max_in_flight: 4
+    max_wait: 2s
+    timeout: 50ms
+    failure_policy: local
+    breaker_threshold: 5
+    quotas:
+      - max: 10000
+        period: daily
+        time_zone: UTC
+    store:
+      type: memory
+      memory:
+        max_keys: 1000
+        shards: 4
+    rules:
+      - path: /users/{id}
+        method: GET
+        match: template
+        max: 2
+        ttl: 1m
+        algorithm: sliding_window_log
+        cost: 2
+      - path: /search
+        method: GET
+        priority: 10
+        max: 1
+        ttl: 1s
+        limits:
+          - max: 100
+            ttl: 1h
+  - name: admin
+    max: 1
+    ttl: 1s
+`
+
+func TestParseConfig(t *testing.T) {
+	conf, err := ParseConfig([]byte(testConfigYAML))
+	if err != nil {
+		t.Fatalf("Config should be valid. Error: %v", err)
+	}
+
+	limiters := conf.NewLimiters()
+	if len(limiters) != 2 {
+		t.Fatalf("Config should build 2 limiters. Limiters: %v", limiters)
+	}
+
+	limiter := limiters["api"]
+	defer limiter.Close()
+	defer limiters["admin"].Close()
+
+	if limiter.Max != 10 || limiter.TTL != 100*time.Millisecond {
+		t.Errorf("Max and TTL are incorrect. Max: %v, TTL: %v", limiter.Max, limiter.TTL)
+	}
+	if limiter.Message != "Slow down." || limiter.StatusCode != 429 {
+		t.Errorf("Message should be set and StatusCode should keep its default. Message: %v, StatusCode: %v", limiter.Message, limiter.StatusCode)
+	}
+	if strings.Join(limiter.IPLookups, ",") != "X-Forwarded-For,RemoteAddr" || strings.Join(limiter.Methods, ",") != "GET,POST" {
+		t.Errorf("Key settings are incorrect. IPLookups: %v, Methods: %v", limiter.IPLookups, limiter.Methods)
+	}
+	if limiter.HeaderStyle != XRateLimitHeaders|IETFHeaders {
+		t.Errorf("HeaderStyle is incorrect. Value: %v", limiter.HeaderStyle)
+	}
+	if limiter.MaxWait != 2*time.Second {
+		t.Errorf("MaxWait is incorrect. Value: %v", limiter.MaxWait)
+	}
+	if limiter.Timeout != 50*time.Millisecond {
+		t.Errorf("Timeout is incorrect. Value: %v", limiter.Timeout)
+	}
+	if limiter.FailurePolicy != FailLocal || limiter.BreakerThreshold != 5 || limiter.BreakerCooldown != 10*time.Second {
+		t.Errorf("Failure settings are incorrect. FailurePolicy: %v, BreakerThreshold: %v, BreakerCooldown: %v", limiter.FailurePolicy, limiter.BreakerThreshold, limiter.BreakerCooldown)
+	}
+	if limiter.MaxInFlight != 4 || limiter.InFlightTTL != time.Minute {
+		t.Errorf("In-flight limit is incorrect. MaxInFlight: %v, InFlightTTL: %v", limiter.MaxInFlight, limiter.InFlightTTL)
+	}
+	if limiter.Algorithm != store.SlidingWindowCounter {
+		t.Errorf("Algorithm is incorrect. Value: %v", limiter.Algorithm)
+	}
+	if len(limiter.Quotas) != 1 || limiter.Quotas[0].Max != 10000 || limiter.Quotas[0].Period != Daily {
+		t.Errorf("Quotas are incorrect. Quotas: %+v", limiter.Quotas)
+	}
+	if _, ok := limiter.Store.(*store.Memory); !ok {
+		t.Errorf("Store should be kept in memory. Store: %T", limiter.Store)
+	}
+
+	request, _ := http.NewRequest("GET", "/users/42", nil)
+	if rule := limiter.Rules.Match(request); rule == nil || rule.Val.Max != 2 || rule.Val.TTL != time.Minute || rule.Val.Algorithm != store.SlidingWindowLog || rule.Cost != 2 {
+		t.Errorf("Template rule should be registered. Rule: %+v", rule)
+	}
+	if rules := limiter.Rules.Rules(); len(rules) != 2 || rules[0].Key.Path != "/search" {
+		t.Errorf("Rules should be ordered by priority. Rules: %+v", rules)
+	} else if len(rules[0].Limits) != 1 || rules[0].Limits[0].Max != 100 || rules[0].Limits[0].TTL != time.Hour {
+		t.Errorf("Additional limits should be registered. Limits: %+v", rules[0].Limits)
+	}
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	conf, err := ParseConfig([]byte(`{
+  "limiters": [
+    {"name": "api", "max": 5, "ttl": "1s", "rules": [{"path": "/a", "method": "GET", "match": "exact", "max": 1, "ttl": "1m"}]}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("JSON config should be valid. Error: %v", err)
+	}
+	if rules := conf.Limiters[0].RateLimits(); len(rules) != 1 || rules[0].Key.Match != MatchExact {
+		t.Errorf("JSON rules should be decoded. Rules: %+v", rules)
+	}
+}
+
+func TestParseConfigLeasing(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+limiters:
+  - name: api
+    max: 100
+    ttl: 10ms
+    store:
+      type: memory
+      leasing:
+        batch_size: 20
+        lease_ttl: 500ms
+`))
+	if err != nil {
+		t.Fatalf("Config should be valid. Error: %v", err)
+	}
+
+	limiter := conf.Limiters[0].NewLimiter()
+	defer limiter.Close()
+	leasing, ok := limiter.Store.(*store.Leasing)
+	if !ok {
+		t.Fatalf("Store should lease its tokens. Store: %T", limiter.Store)
+	}
+	if _, ok := leasing.Remote().(*store.Memory); !ok {
+		t.Errorf("Tokens should be leased from memory. Store: %T", leasing.Remote())
+	}
+}
+
+func TestParseConfigKeys(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+limiters:
+  - name: api
+    max: 1
+    ttl: 1s
+    methods: [GET]
+    keys: [method, "header:X-API-Key", path]
+`))
+	if err != nil {
+		t.Fatalf("Config should be valid. Error: %v", err)
+	}
+
+	limiter := conf.Limiters[0].NewLimiter()
+	defer limiter.Close()
+	request, _ := http.NewRequest("GET", "/search", nil)
+	request.Header.Set("X-API-Key", "k1")
+	if keys := limiter.Keys(request); len(keys) != 1 || strings.Join(keys[0], "|") != "GET|X-API-Key|k1|/search" {
+		t.Errorf("Keys should be made of the configured parts. Keys: %v", keys)
+	}
+}
+
+func TestParseConfigAnonymousKey(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+limiters:
+  - name: api
+    max: 1
+    ttl: 1s
+    keys: ["hash:bearer_token"]
+    anonymous_key: anonymous
+`))
+	if err != nil {
+		t.Fatalf("Config should be valid. Error: %v", err)
+	}
+
+	limiter := conf.Limiters[0].NewLimiter()
+	defer limiter.Close()
+	request, _ := http.NewRequest("GET", "/", nil)
+	if keys := limiter.Keys(request); len(keys) != 1 || keys[0][0] != "anonymous" {
+		t.Errorf("Requests without token should be counted in the anonymous bucket. Keys: %v", keys)
+	}
+
+	request.Header.Set("Authorization", "Bearer secret")
+	if keys := limiter.Keys(request); len(keys) != 1 || len(keys[0][0]) != 64 {
+		t.Errorf("Token should be hashed. Keys: %v", keys)
+	}
+}
+
+func TestParseConfigJWT(t *testing.T) {
+	der, _ := x509.MarshalPKIXPublicKey(&ecdsaKey.PublicKey)
+	publicKey := strings.ReplaceAll(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), "\n", "\n          ")
+	conf, err := ParseConfig([]byte(`
+limiters:
+  - name: api
+    max: 1
+    ttl: 1m
+    keys: ["claim:sub"]
+    anonymous_key: anonymous
+    jwt:
+      secrets: {"": 0123456789abcdef0123456789abcdef}
+      public_keys:
+        es: |
+          ` + publicKey + `
+    tiers:
+      claim: plan
+      limits:
+        pro: {max: 3, ttl: 1m}
+`))
+	if err != nil {
+		t.Fatalf("Config should be valid. Error: %v", err)
+	}
+
+	limiter := conf.Limiters[0].NewLimiter()
+	defer limiter.Close()
+	tokens := []string{
+		signToken(t, "HS256", "", jwtSecret, map[string]interface{}{"sub": "u1", "plan": "pro"}),
+		signToken(t, "ES256", "es", ecdsaKey, map[string]interface{}{"sub": "u1", "plan": "pro"}),
+	}
+	for _, token := range tokens {
+		request, _ := http.NewRequest("GET", "/", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		if keys := limiter.Keys(request); len(keys) != 1 || strings.Join(keys[0], "|") != "sub|u1" {
+			t.Errorf("Requests should be keyed by the subject of their token. Keys: %v", keys)
+		}
+		if rule := limiter.LimitRule(request, nil); rule == nil || rule.Val.Max != 3 {
+			t.Errorf("Requests should be limited by the tier of their plan. Rule: %+v", rule)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	if keys := limiter.Keys(request); len(keys) != 1 || keys[0][0] != "anonymous" {
+		t.Errorf("Requests without token should be counted in the anonymous bucket. Keys: %v", keys)
+	}
+	if rule := limiter.LimitRule(request, nil); rule != nil {
+		t.Errorf("Requests without token should be limited by the limiter. Rule: %+v", rule)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	cases := map[string]string{
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    maxx: 2\n":                                                                            "line 5: field maxx not found",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 5\n":                                                                                          "line 4: cannot unmarshal !!int `5` into time.Duration",
+		"limiters:\n  - name: api\n    max: 0\n    ttl: 1s\n":                                                                                         "line 3: max of limiter \"api\" must be positive",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n  - name: api\n    max: 1\n    ttl: 1s\n":                                                 "line 5: limiter name \"api\" is duplicated",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    rules:\n      - {path: /a, max: 1, ttl: 1s}\n      - {path: /a, max: 1, ttl: 1s}\n":   "line 7: rule \"/a\" of limiter \"api\" is duplicated",
+		"limiters:\n  - max: 1\n    ttl: 1s\n":                                                                                                        "line 2: limiter name is required",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    store:\n      type: disk\n":                                                           "line 6: unknown store type \"disk\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    response_headers: [legacy, draft]\n":                                                  "line 5: unknown response_headers \"draft\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    rules:\n      - path: /a(\n        max: 1\n        ttl: 1s\n":                         "line 6: invalid path of rule \"/a(\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    rules:\n      - path: /a\n        match: glob\n        max: 1\n        ttl: 1s\n":     "line 7: unknown match \"glob\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    algorithm: leaky_bucket\n":                                                            "line 5: unknown rate-limit algorithm \"leaky_bucket\" of limiter \"api\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    rules:\n      - path: /a\n        max: 1\n        ttl: 1s\n        algorithm: leak\n": "line 9: unknown rate-limit algorithm \"leak\" of rule \"/a\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    quotas:\n      - max: 1\n        period: yearly\n":                                    "line 7: unknown quota period \"yearly\" of limiter \"api\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    quotas:\n      - max: 1\n        period: daily\n        time_zone: Mars/Base\n":       "line 8: unknown time_zone \"Mars/Base\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    rules:\n      - {path: /a, max: 1, ttl: 1s, limits: [max: 10]}\n":                     "line 6: ttl of limit of rule \"/a\" must be positive",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    rules:\n      - path: /a\n        max: 1\n        ttl: 1s\n        cost: -1\n":        "line 9: cost of rule \"/a\" must not be negative",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    max_queue: -1\n":                                                                      "line 5: max_queue of limiter \"api\" must not be negative",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    timeout: -1s\n":                                                                       "line 5: timeout of limiter \"api\" must not be negative",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    failure_policy: retry\n":                                                              "line 5: unknown failure policy \"retry\" of limiter \"api\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    store:\n      leasing:\n        batch_size: -1\n":                                     "line 7: leasing settings of limiter \"api\" must not be negative",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    keys: [ip, \"header:\"]\n":                                                            "line 5: unknown key \"header:\" of limiter \"api\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    keys: [\"hash:token\"]\n":                                                             "line 5: unknown key \"token\" of limiter \"api\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    jwt:\n      leeway: 1s\n":                                                             "line 6: jwt of limiter \"api\" requires secrets or public_keys",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    jwt:\n      secrets: {\"\": \"\"}\n":                                                  "line 6: jwt secret \"\" of limiter \"api\" must be at least 32 bytes long",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    jwt:\n      public_keys: {k1: secret}\n":                                              "line 6: invalid jwt public key \"k1\" of limiter \"api\"",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    tiers:\n      claim: plan\n      limits:\n        pro: {max: 0, ttl: 1s}\n":           "line 8: max of tier of limiter \"api\" must be positive",
+		"limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    tiers:\n      limits:\n        pro: {max: 1, ttl: 1s}\n":                              "line 6: tiers claim of limiter \"api\" is required",
+		"limiters: [\n": "line 1: did not find expected node content",
+	}
+
+	for data, expected := range cases {
+		_, err := ParseConfig([]byte(data))
+		if err == nil {
+			t.Errorf("Config should be invalid:\n%v", data)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error should contain %q. Error: %v", expected, err)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tollbooth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "limits.yaml")
+	if err := ioutil.WriteFile(path, []byte(testConfigYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Config file should be loaded. Error: %v", err)
+	}
+	if len(conf.Limiters) != 2 {
+		t.Errorf("Config file should define 2 limiters. Limiters: %+v", conf.Limiters)
+	}
+
+	if _, err := LoadConfigFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Loading a missing file should fail.")
+	}
+}
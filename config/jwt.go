@@ -0,0 +1,370 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is wrapped by the errors of tokens failing verification.
+var ErrInvalidToken = errors.New("invalid token")
+
+// MinSecretLength is the minimum length of the HS256 secrets of a configuration file,
+// the size of the SHA-256 output. Shorter secrets can be guessed to forge tokens.
+const MinSecretLength = 32
+
+// Claims are the claims of a JSON Web Token. Numbers are decoded as json.Number.
+type Claims map[string]interface{}
+
+// String returns the value of the string, number or boolean claim of the given name,
+// or an empty string when it is not set or is an object or an array.
+func (c Claims) String(name string) string {
+	switch value := c[name].(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return ""
+	}
+}
+
+// JWTVerifier verifies the signature and the validity period of HS256, RS256 and ES256 JSON Web Tokens.
+type JWTVerifier struct {
+	// Keys verifying the signatures by key id, the "kid" header of the tokens. Tokens without key id,
+	// or with an unknown one, are verified by the key of id "". HS256 tokens are verified by []byte
+	// secrets, RS256 tokens by *rsa.PublicKey and ES256 tokens by *ecdsa.PublicKey.
+	Keys map[string]crypto.PublicKey
+
+	// Clock skew tolerated when checking the "exp" and "nbf" claims.
+	Leeway time.Duration
+
+	// Expected "iss" and "aud" claims, not checked when empty.
+	Issuer   string
+	Audience string
+
+	now func() time.Time
+}
+
+// NewJWTVerifier is a constructor for JWTVerifier.
+func NewJWTVerifier(keys map[string]crypto.PublicKey) *JWTVerifier {
+	return &JWTVerifier{Keys: keys, now: time.Now}
+}
+
+// ParsePublicKey parses a PEM encoded RSA or ECDSA public key, or certificate, for JWTVerifier.Keys.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM public key found")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return checkPublicKey(cert.PublicKey)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return checkPublicKey(key)
+	}
+}
+
+func checkPublicKey(key crypto.PublicKey) (crypto.PublicKey, error) {
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// Verify returns the claims of token once its signature, expiration and, when set, issuer and audience
+// are verified. The key of the token must match its algorithm, so that a public key is never used
+// as an HMAC secret.
+func (v *JWTVerifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature: %v", ErrInvalidToken, err)
+	}
+
+	key, found := v.Keys[header.KeyID]
+	if !found {
+		key, found = v.Keys[""]
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, header.KeyID)
+	}
+	if err := verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+// validate checks the validity period, issuer and audience of claims.
+func (v *JWTVerifier) validate(claims Claims) error {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+
+	if exp, found := claims["exp"]; found {
+		t, err := numericDate(exp)
+		if err != nil {
+			return fmt.Errorf("exp: %v", err)
+		}
+		if !now.Before(t.Add(v.Leeway)) {
+			return errors.New("token is expired")
+		}
+	}
+	if nbf, found := claims["nbf"]; found {
+		t, err := numericDate(nbf)
+		if err != nil {
+			return fmt.Errorf("nbf: %v", err)
+		}
+		if now.Add(v.Leeway).Before(t) {
+			return errors.New("token is not valid yet")
+		}
+	}
+
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.String("iss"))
+	}
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return errors.New("unexpected audience")
+	}
+	return nil
+}
+
+// verifySignature verifies signature of the signed header and payload with key, for algorithm.
+func verifySignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch algorithm {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key is not an HS256 secret")
+		}
+		// Anyone could sign tokens with an empty secret, such as one read from an unset variable.
+		if len(secret) == 0 {
+			return errors.New("HS256 secret is empty")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errors.New("signature mismatch")
+		}
+	case "RS256":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key is not an RS256 public key")
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("signature mismatch")
+		}
+	case "ES256":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve != elliptic.P256() {
+			return errors.New("key is not an ES256 public key")
+		}
+		// The signature is the concatenation of R and S, 32 bytes each.
+		if len(signature) != 64 {
+			return errors.New("signature mismatch")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return errors.New("signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	return nil
+}
+
+// decodeSegment decodes the base64url JSON segment of a token into v, numbers as json.Number.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// numericDate returns the time of a NumericDate claim, in seconds since the epoch.
+func numericDate(value interface{}) (time.Time, error) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, errors.New("not a number")
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*float64(time.Second))), nil
+}
+
+// hasAudience returns whether the "aud" claim, a string or an array of strings, contains audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying claims already verified, for instance by an authentication
+// middleware, so that Claim and Tiers use them instead of verifying the bearer token again.
+func WithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims carried by ctx, nil when there are none.
+func ClaimsFromContext(ctx context.Context) Claims {
+	claims, _ := ctx.Value(claimsKey{}).(Claims)
+	return claims
+}
+
+// claimsCache holds the claims of the bearer token of a request by verifier, nil when it is invalid.
+type claimsCache struct {
+	claims map[*JWTVerifier]Claims
+	sync.Mutex
+}
+
+type claimsCacheKey struct{}
+
+// WithClaimsCache returns a shallow copy of r whose bearer token is verified at most once by every
+// verifier, however many times Claim and Tiers look for its claims, or r when it already has one.
+// The middlewares of tollbooth call it on every request.
+func WithClaimsCache(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(claimsCacheKey{}).(*claimsCache); ok {
+		return r
+	}
+	cache := &claimsCache{claims: make(map[*JWTVerifier]Claims)}
+	return r.WithContext(context.WithValue(r.Context(), claimsCacheKey{}, cache))
+}
+
+// requestClaims returns the claims carried by the context of r, or else the claims of its bearer token
+// verified by verifier, once per request with WithClaimsCache. It returns nil when there are none or
+// the token is invalid.
+func requestClaims(r *http.Request, verifier *JWTVerifier) Claims {
+	if claims := ClaimsFromContext(r.Context()); claims != nil {
+		return claims
+	}
+
+	token := bearerToken(r)
+	if verifier == nil || token == "" {
+		return nil
+	}
+
+	cache, ok := r.Context().Value(claimsCacheKey{}).(*claimsCache)
+	if !ok {
+		claims, _ := verifier.Verify(token)
+		return claims
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	claims, found := cache.claims[verifier]
+	if !found {
+		claims, _ = verifier.Verify(token)
+		cache.claims[verifier] = claims
+	}
+	return claims
+}
+
+// Claim extracts the name and value of every given claim of the request, such as "sub" or "tenant_id",
+// from the claims of its context or else of its bearer token verified by verifier, which may be nil.
+// Requests without claims, or with an invalid token, have no key. See Fallback.
+func Claim(verifier *JWTVerifier, names ...string) KeyFunc {
+	return func(r *http.Request) [][]string {
+		claims := requestClaims(r, verifier)
+		return fields(names, func(_ *http.Request, name string) string {
+			return claims.String(name)
+		})(r)
+	}
+}
+
+// Tiers selects the limit of requests by the value of one of their claims, such as their plan.
+// Its Limit method is meant for Limiter.LimitFunc.
+type Tiers struct {
+	// Verifier of bearer tokens, nil to only use the claims of the request contexts.
+	Verifier *JWTVerifier
+
+	// Name of the claim selecting the tier, such as "plan".
+	Claim string
+
+	// Limits by claim value.
+	Limits map[string]LimitValue
+
+	// Limit of the requests without the claim or with an unknown value.
+	// Nil leaves them to the limiter and its API rate limits.
+	Default *LimitValue
+}
+
+// Limit returns the limit of the tier of r.
+func (t *Tiers) Limit(r *http.Request) *LimitValue {
+	if limit, found := t.Limits[requestClaims(r, t.Verifier).String(t.Claim)]; found {
+		return &limit
+	}
+	return t.Default
+}
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	jwtSecret = []byte("0123456789abcdef0123456789abcdef")
+
+	rsaKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	ecdsaKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// signToken returns a token of claims signed with key by algorithm, with the key id kid when not empty.
+func signToken(t *testing.T, algorithm string, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": algorithm, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestVerifier() *JWTVerifier {
+	return NewJWTVerifier(map[string]crypto.PublicKey{
+		"":   jwtSecret,
+		"rs": &rsaKey.PublicKey,
+		"es": &ecdsaKey.PublicKey,
+	})
+}
+
+func TestJWTVerify(t *testing.T) {
+	verifier := newTestVerifier()
+	claims := map[string]interface{}{"sub": "u1", "tenant_id": 42, "exp": time.Now().Add(time.Hour).Unix()}
+
+	tokens := map[string]string{
+		"HS256": signToken(t, "HS256", "", jwtSecret, claims),
+		"RS256": signToken(t, "RS256", "rs", rsaKey, claims),
+		"ES256": signToken(t, "ES256", "es", ecdsaKey, claims),
+	}
+	for algorithm, token := range tokens {
+		verified, err := verifier.Verify(token)
+		if err != nil {
+			t.Errorf("%v token should be valid. Error: %v", algorithm, err)
+			continue
+		}
+		if verified.String("sub") != "u1" || verified.String("tenant_id") != "42" {
+			t.Errorf("Claims of %v token are incorrect. Claims: %v", algorithm, verified)
+		}
+	}
+}
+
+func TestJWTVerifyErrors(t *testing.T) {
+	now := time.Now()
+	valid := map[string]interface{}{"sub": "u1", "iss": "auth", "aud": []string{"api"}, "exp": now.Add(time.Hour).Unix()}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[name] = value
+		return claims
+	}
+	publicKey, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	tampered := strings.Split(signToken(t, "HS256", "", jwtSecret, valid), ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))
+
+	cases := map[string]string{
+		"wrong secret":          signToken(t, "HS256", "", []byte("guess"), valid),
+		"none algorithm":        signToken(t, "none", "", nil, valid),
+		"public key as secret":  signToken(t, "HS256", "rs", publicKey, valid),
+		"algorithm of key":      signToken(t, "RS256", "es", rsaKey, valid),
+		"unknown key id":        signToken(t, "ES256", "other", ecdsaKey, valid),
+		"expired":               signToken(t, "HS256", "", jwtSecret, with("exp", now.Add(-time.Minute).Unix())),
+		"not valid yet":         signToken(t, "HS256", "", jwtSecret, with("nbf", now.Add(time.Minute).Unix())),
+		"wrong issuer":          signToken(t, "HS256", "", jwtSecret, with("iss", "other")),
+		"wrong audience":        signToken(t, "HS256", "", jwtSecret, with("aud", "other")),
+		"malformed":             "not.a.token",
+		"missing segment":       "e30.e30",
+		"tampered claims":       strings.Join(tampered, "."),
+		"not numeric exp claim": signToken(t, "HS256", "", jwtSecret, with("exp", "tomorrow")),
+	}
+
+	verifier := newTestVerifier()
+	verifier.Issuer, verifier.Audience = "auth", "api"
+	if _, err := verifier.Verify(signToken(t, "HS256", "", jwtSecret, valid)); err != nil {
+		t.Fatalf("Token should be valid. Error: %v", err)
+	}
+	for name, token := range cases {
+		if _, err := verifier.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Token with %v should be invalid. Error: %v", name, err)
+		}
+	}
+
+	verifier.Leeway = 2 * time.Minute
+	if _, err := verifier.Verify(cases["expired"]); err != nil {
+		t.Errorf("Token expired within the leeway should be valid. Error: %v", err)
+	}
+	delete(verifier.Keys, "")
+	if _, err := verifier.Verify(signToken(t, "HS256", "", jwtSecret, valid)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Token without key should be invalid. Error: %v", err)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	for _, key := range []crypto.PublicKey{&rsaKey.PublicKey, &ecdsaKey.PublicKey} {
+		der, _ := x509.MarshalPKIXPublicKey(key)
+		parsed, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		if err != nil || !reflect.DeepEqual(parsed, key) {
+			t.Errorf("Public key should be parsed. Key: %v, Error: %v", parsed, err)
+		}
+	}
+
+	der := x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)
+	if _, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: der})); err != nil {
+		t.Errorf("PKCS1 public key should be parsed. Error: %v", err)
+	}
+	if _, err := ParsePublicKey([]byte("secret")); err == nil {
+		t.Errorf("Data without PEM block should not be parsed")
+	}
+}
+
+func TestClaim(t *testing.T) {
+	keyFunc := Keys(Claim(newTestVerifier(), "tenant_id", "sub"), Path())
+	token := signToken(t, "ES256", "es", ecdsaKey, map[string]interface{}{"sub": "u1", "tenant_id": 42})
+
+	request, _ := http.NewRequest("GET", "/search", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	expected := [][]string{{"tenant_id", "42", "/search"}, {"sub", "u1", "/search"}}
+	if keys := keyFunc(request); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Keys of the token claims are incorrect. Keys: %v, Expected: %v", keys, expected)
+	}
+
+	request.Header.Set("Authorization", "Bearer "+token+"x")
+	if keys := keyFunc(request); len(keys) != 0 {
+		t.Errorf("Requests with invalid token should have no key. Keys: %v", keys)
+	}
+
+	request = request.WithContext(WithClaims(request.Context(), Claims{"sub": "u2"}))
+	if keys := keyFunc(request); !reflect.DeepEqual(keys, [][]string{{"sub", "u2", "/search"}}) {
+		t.Errorf("Claims of the context should be used. Keys: %v", keys)
+	}
+}
+
+func TestWithClaimsCache(t *testing.T) {
+	verifier := newTestVerifier()
+	keyFunc := Claim(verifier, "sub")
+	tiers := &Tiers{Verifier: verifier, Claim: "plan", Limits: map[string]LimitValue{"pro": {Max: 3, TTL: time.Minute}}}
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer "+signToken(t, "HS256", "", jwtSecret, map[string]interface{}{"sub": "u1", "plan": "pro"}))
+	request = WithClaimsCache(request)
+	if WithClaimsCache(request) != request {
+		t.Errorf("Request with a cache should be kept.")
+	}
+	if keys := keyFunc(request); !reflect.DeepEqual(keys, [][]string{{"sub", "u1"}}) {
+		t.Fatalf("Keys of the token claims are incorrect. Keys: %v", keys)
+	}
+
+	// Claims verified once are reused, the token can't be verified anymore.
+	verifier.Keys = nil
+	if limit := tiers.Limit(request); limit == nil || limit.Max != 3 {
+		t.Errorf("Claims of the request should be verified once. Limit: %v", limit)
+	}
+}
+
+func TestJWTEmptySecret(t *testing.T) {
+	verifier := NewJWTVerifier(map[string]crypto.PublicKey{"": []byte{}})
+	if _, err := verifier.Verify(signToken(t, "HS256", "", []byte{}, map[string]interface{}{"sub": "admin"})); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Token signed with an empty secret should be invalid. Error: %v", err)
+	}
+}
+
+func TestTiers(t *testing.T) {
+	limiter := NewLimiter(1, time.Minute, nil)
+	defer limiter.Close()
+	limiter.KeyFunc = Keys(Claim(nil, "sub"))
+	limiter.LimitFunc = (&Tiers{
+		Claim:  "plan",
+		Limits: map[string]LimitValue{"pro": {Max: 3, TTL: time.Minute}},
+	}).Limit
+
+	cases := []struct {
+		claims  Claims
+		allowed int
+	}{
+		{Claims{"sub": "free", "plan": "free"}, 1},
+		{Claims{"sub": "pro", "plan": "pro"}, 3},
+	}
+	for _, c := range cases {
+		request, _ := http.NewRequest("GET", "/", nil)
+		request = request.WithContext(WithClaims(request.Context(), c.claims))
+		key := limiter.Keys(request)[0]
+		rule := limiter.LimitRule(request, nil)
+
+		allowed := 0
+		for i := 0; i < 5; i++ {
+			if limiter.AllowRule(key[0]+"|"+key[1], rule).Allowed {
+				allowed++
+			}
+		}
+		if allowed != c.allowed {
+			t.Errorf("Requests of plan %v should be limited by their tier. Allowed: %v, Expected: %v", c.claims["plan"], allowed, c.allowed)
+		}
+	}
+
+	rules := NewRouter()
+	rules.Add(RateLimit{Key: LimitKey{Path: "/search", Match: MatchExact}, Val: LimitValue{Max: 10, TTL: time.Second}, Cost: 2})
+	request, _ := http.NewRequest("GET", "/search", nil)
+	if rule := limiter.LimitRule(request, rules.Match(request)); rule.Val.Max != 10 {
+		t.Errorf("Requests without tier should keep the API rate limit. Rule: %+v", rule)
+	}
+
+	request = request.WithContext(WithClaims(request.Context(), Claims{"plan": "pro"}))
+	if rule := limiter.LimitRule(request, rules.Match(request)); rule.Val.Max != 3 || rule.Cost != 2 || rules.Match(request).Val.Max != 10 {
+		t.Errorf("Tier should override the limit of a copy of the API rate limit. Rule: %+v", rule)
+	}
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"net/http"
+
+	"github.com/aw16com/tollbooth/libstring"
+)
+
+// KeyFunc extracts the keys of the buckets a request is counted in, each made of parts joined by "|".
+// The request is counted in every key, and not limited when there is none.
+// Built-in extractors are KeyFuncs returning a single part, or the name and value of a field,
+// and are combined with Keys.
+type KeyFunc func(r *http.Request) [][]string
+
+// DefaultIPLookups are the places IP looks for the address of the client when none is given.
+var DefaultIPLookups = []string{"RemoteAddr", "X-Forwarded-For", "X-Real-IP"}
+
+// Keys combines extractors in the given order: every key of r is made of one key of each extractor,
+// so r has no key when one of them has none, and a key per value of extractors with several values.
+func Keys(extractors ...KeyFunc) KeyFunc {
+	return func(r *http.Request) [][]string {
+		sliceKeys := [][]string{{}}
+		for _, extract := range extractors {
+			parts := extract(r)
+			combined := make([][]string, 0, len(sliceKeys)*len(parts))
+			for _, keys := range sliceKeys {
+				for _, part := range parts {
+					key := make([]string, 0, len(keys)+len(part))
+					combined = append(combined, append(append(key, keys...), part...))
+				}
+			}
+			sliceKeys = combined
+		}
+		return sliceKeys
+	}
+}
+
+// IP extracts the address of the client from the first of lookups found in the request,
+// DefaultIPLookups when none is given. See libstring.RemoteIP.
+func IP(lookups ...string) KeyFunc {
+	if len(lookups) == 0 {
+		lookups = DefaultIPLookups
+	}
+	return ip(lookups)
+}
+
+func ip(lookups []string) KeyFunc {
+	return func(r *http.Request) [][]string {
+		return single(libstring.RemoteIP(lookups, r))
+	}
+}
+
+// Path extracts the path of the request.
+func Path() KeyFunc {
+	return func(r *http.Request) [][]string {
+		return [][]string{{r.URL.Path}}
+	}
+}
+
+// Route extracts the path of the rate limit of rt matching the request, such as "/users/{id}",
+// so that every path matching it shares a bucket. Requests matching no rate limit are keyed by their path.
+func Route(rt *Router) KeyFunc {
+	return func(r *http.Request) [][]string {
+		if rule := rt.Match(r); rule != nil {
+			return [][]string{{rule.Key.Path}}
+		}
+		return [][]string{{r.URL.Path}}
+	}
+}
+
+// Method extracts the method of the request. When methods are given, requests of other methods have no key.
+func Method(methods ...string) KeyFunc {
+	return method(methods, len(methods) == 0)
+}
+
+func method(methods []string, any bool) KeyFunc {
+	return func(r *http.Request) [][]string {
+		if !any && !libstring.StringInSlice(methods, r.Method) {
+			return nil
+		}
+		return [][]string{{r.Method}}
+	}
+}
+
+// Host extracts the host the request is sent to.
+func Host() KeyFunc {
+	return func(r *http.Request) [][]string {
+		return single(r.Host)
+	}
+}
+
+// Header extracts the name and value of every given header set in the request,
+// the request has no key when none is set.
+func Header(names ...string) KeyFunc {
+	return fields(names, func(r *http.Request, name string) string {
+		return r.Header.Get(name)
+	})
+}
+
+// Query extracts the name and value of every given query parameter set in the request,
+// the request has no key when none is set.
+func Query(params ...string) KeyFunc {
+	return fields(params, func(r *http.Request, param string) string {
+		return r.URL.Query().Get(param)
+	})
+}
+
+// Cookie extracts the name and value of every given cookie sent with the request,
+// the request has no key when none is sent.
+func Cookie(names ...string) KeyFunc {
+	return fields(names, func(r *http.Request, name string) string {
+		if cookie, err := r.Cookie(name); err == nil {
+			return cookie.Value
+		}
+		return ""
+	})
+}
+
+// BasicAuthUser extracts the basic auth username of the request. When users are given,
+// requests of other users have no key.
+func BasicAuthUser(users ...string) KeyFunc {
+	return basicAuthUser(users, len(users) == 0)
+}
+
+func basicAuthUser(users []string, any bool) KeyFunc {
+	return func(r *http.Request) [][]string {
+		username, _, ok := r.BasicAuth()
+		if !ok || (!any && !libstring.StringInSlice(users, username)) {
+			return nil
+		}
+		return [][]string{{username}}
+	}
+}
+
+// Keys returns the keys of the buckets r is counted in, extracted by KeyFunc,
+// or else by the IP, path and the Methods, Headers and BasicAuthUsers that are set.
+func (l *Limiter) Keys(r *http.Request) [][]string {
+	if l.KeyFunc != nil {
+		return l.KeyFunc(r)
+	}
+	return l.defaultKeys(r)
+}
+
+// defaultKeys returns the keys of r made of its IP, path and the Methods, Headers and BasicAuthUsers that are set.
+func (l *Limiter) defaultKeys(r *http.Request) [][]string {
+	extractors := []KeyFunc{ip(l.IPLookups), Path()}
+	if l.Methods != nil {
+		extractors = append(extractors, method(l.Methods, false))
+	}
+	if l.Headers != nil {
+		extractors = append(extractors, Header(l.Headers...))
+	}
+	if l.BasicAuthUsers != nil {
+		extractors = append(extractors, basicAuthUser(l.BasicAuthUsers, false))
+	}
+	return Keys(extractors...)(r)
+}
+
+// fields extracts the name and value of every given field of the request whose value is not empty.
+func fields(names []string, value func(r *http.Request, name string) string) KeyFunc {
+	return func(r *http.Request) [][]string {
+		var parts [][]string
+		for _, name := range names {
+			if v := value(r, name); v != "" {
+				parts = append(parts, []string{name, v})
+			}
+		}
+		return parts
+	}
+}
+
+// single returns the part made of value, or nothing when it is empty.
+func single(value string) [][]string {
+	if value == "" {
+		return nil
+	}
+	return [][]string{{value}}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newKeysRequest(t *testing.T) *http.Request {
+	request, err := http.NewRequest("GET", "http://api.example.com/users/42?api_key=k1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+	request.Header.Set("X-Auth-Token", "secret")
+	request.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	request.SetBasicAuth("bro", "tato")
+	return request
+}
+
+func TestLimiterKeys(t *testing.T) {
+	ip, path := "2601:7:1c82:4097:59a0:a80b:2841:b8c8", "/users/42"
+	cases := []struct {
+		methods, headers, users []string
+		expected                [][]string
+	}{
+		{nil, nil, nil, [][]string{{ip, path}}},
+		{[]string{"GET"}, nil, nil, [][]string{{ip, path, "GET"}}},
+		{[]string{"POST"}, nil, nil, [][]string{}},
+		{nil, []string{"X-Auth-Token", "X-Missing"}, nil, [][]string{{ip, path, "X-Auth-Token", "secret"}}},
+		{nil, nil, []string{"bro"}, [][]string{{ip, path, "bro"}}},
+		{nil, nil, []string{}, [][]string{}},
+		{[]string{"GET"}, []string{"X-Auth-Token"}, nil, [][]string{{ip, path, "GET", "X-Auth-Token", "secret"}}},
+		{[]string{"GET"}, nil, []string{"bro"}, [][]string{{ip, path, "GET", "bro"}}},
+		{[]string{"GET"}, []string{"X-Auth-Token"}, []string{"bro"}, [][]string{{ip, path, "GET", "X-Auth-Token", "secret", "bro"}}},
+		{[]string{"GET"}, []string{"X-Auth-Token"}, []string{"joe"}, [][]string{}},
+	}
+
+	for _, c := range cases {
+		limiter := NewLimiter(1, time.Second, nil)
+		limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr"}
+		limiter.Methods, limiter.Headers, limiter.BasicAuthUsers = c.methods, c.headers, c.users
+
+		if keys := limiter.Keys(newKeysRequest(t)); !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("Keys of Methods %v, Headers %v and BasicAuthUsers %v are incorrect. Keys: %v, Expected: %v", c.methods, c.headers, c.users, keys, c.expected)
+		}
+		limiter.Close()
+	}
+
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Forwarded-For"}
+	if keys := limiter.Keys(newKeysRequest(t)); len(keys) != 0 {
+		t.Errorf("Requests without IP should have no key. Keys: %v", keys)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	request := newKeysRequest(t)
+	rules := NewRouter()
+	rules.Add(RateLimit{Key: LimitKey{Path: "/users/{id}", Match: MatchTemplate}, Val: LimitValue{Max: 1, TTL: time.Second}})
+
+	cases := []struct {
+		keyFunc  KeyFunc
+		expected [][]string
+	}{
+		{Keys(Host(), BasicAuthUser()), [][]string{{"api.example.com", "bro"}}},
+		{Keys(Query("api_key"), IP("RemoteAddr")), [][]string{{"api_key", "k1", "10.0.0.1"}}},
+		{Keys(Route(rules), Method()), [][]string{{"/users/{id}", "GET"}}},
+		{Keys(Route(NewRouter())), [][]string{{"/users/42"}}},
+		{Keys(Cookie("session"), Path()), [][]string{{"session", "s1", "/users/42"}}},
+		{Keys(IP(), Header("X-Auth-Token", "X-Real-IP")), [][]string{{"10.0.0.1", "X-Auth-Token", "secret"}, {"10.0.0.1", "X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8"}}},
+		{Keys(Path(), Cookie("missing")), [][]string{}},
+		{Keys(Path(), Method("POST")), [][]string{}},
+		{Keys(Path(), BasicAuthUser("joe")), [][]string{}},
+	}
+
+	for i, c := range cases {
+		if keys := c.keyFunc(request); !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("Keys of case %d are incorrect. Keys: %v, Expected: %v", i, keys, c.expected)
+		}
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.Methods = []string{"POST"}
+	limiter.KeyFunc = Keys(Query("api_key"))
+
+	if keys := limiter.Keys(newKeysRequest(t)); !reflect.DeepEqual(keys, [][]string{{"api_key", "k1"}}) {
+		t.Errorf("KeyFunc should replace the key settings of the limiter. Keys: %v", keys)
+	}
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aw16com/tollbooth/store"
+)
+
+// Period is the calendar period after which a Quota is reset.
+type Period int
+
+const (
+	// Hourly quotas are reset at the beginning of every hour.
+	Hourly Period = iota + 1
+
+	// Daily quotas are reset at midnight.
+	Daily
+
+	// Weekly quotas are reset on Monday at midnight.
+	Weekly
+
+	// Monthly quotas are reset at midnight on the first day of the month.
+	Monthly
+)
+
+var periodNames = map[Period]string{
+	Hourly:  "hourly",
+	Daily:   "daily",
+	Weekly:  "weekly",
+	Monthly: "monthly",
+}
+
+// String returns the name of the period as accepted by ParsePeriod.
+func (p Period) String() string {
+	if name, found := periodNames[p]; found {
+		return name
+	}
+	return fmt.Sprintf("Period(%d)", int(p))
+}
+
+// ParsePeriod returns the period of the given name.
+func ParsePeriod(name string) (Period, error) {
+	for period, periodName := range periodNames {
+		if periodName == name {
+			return period, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown quota period %q", name)
+}
+
+// Quota limits the number of requests of a key in a calendar period, such as 10000 calls a day.
+// Requests count for their cost. Quotas are kept by the store of the limiter: a store.Memory
+// reaching MaxKeys may evict the bucket of a quota like any other, resetting it.
+type Quota struct {
+	// Maximum number of requests per period.
+	Max int64
+
+	Period Period
+
+	// Time zone of the period boundaries. Default is UTC.
+	Location *time.Location
+}
+
+// Window returns the start and end of the period containing now.
+func (q Quota) Window(now time.Time) (time.Time, time.Time) {
+	location := q.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	t := now.In(location)
+	year, month, day := t.Date()
+	switch q.Period {
+	case Hourly:
+		start := time.Date(year, month, day, t.Hour(), 0, 0, 0, location)
+		return start, start.Add(time.Hour)
+	case Weekly:
+		day -= (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day, 0, 0, 0, 0, location), time.Date(year, month, day+7, 0, 0, 0, 0, location)
+	case Monthly:
+		return time.Date(year, month, 1, 0, 0, 0, 0, location), time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, location), time.Date(year, month, day+1, 0, 0, 0, 0, location)
+	}
+}
+
+// QuotaUsage reports how much of a quota a key used in the current period.
+type QuotaUsage struct {
+	Quota Quota
+
+	// Number of requests counted in the current period.
+	Used int64
+
+	// Number of requests left in the current period.
+	Remaining int64
+
+	// End of the current period.
+	ResetAt time.Time
+}
+
+// QuotaUsage returns the usage of every quota of the limiter by the bucket identified by key,
+// for instance to show it on billing pages.
+func (l *Limiter) QuotaUsage(key string) ([]QuotaUsage, error) {
+	return l.QuotaUsageContext(context.Background(), key)
+}
+
+// QuotaUsageContext is QuotaUsage calling the store with ctx.
+func (l *Limiter) QuotaUsageContext(ctx context.Context, key string) ([]QuotaUsage, error) {
+	now := time.Now()
+	usages := make([]QuotaUsage, 0, len(l.Quotas))
+	for _, quota := range l.Quotas {
+		quotaKey, limit, end := quota.bucket(key, now)
+		state, err := l.peekQuota(ctx, quotaKey, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		usages = append(usages, QuotaUsage{
+			Quota:     quota,
+			Used:      quota.Max - state.Remaining,
+			Remaining: state.Remaining,
+			ResetAt:   end,
+		})
+	}
+	return usages, nil
+}
+
+// peekQuota reads the bucket of a quota.
+func (l *Limiter) peekQuota(ctx context.Context, key string, limit store.Limit) (state store.State, err error) {
+	err = l.call(ctx, "peek", key, func(ctx context.Context) error {
+		state, err = l.Store.Peek(ctx, key, limit)
+		return err
+	})
+	return state, err
+}
+
+// bucket returns the key and limit of the bucket counting the requests of key in the period containing now,
+// and the end of the period.
+func (q Quota) bucket(key string, now time.Time) (string, store.Limit, time.Time) {
+	start, end := q.Window(now)
+	quotaKey := key + ":quota:" + q.Period.String() + ":" + strconv.FormatInt(start.Unix(), 10)
+	return quotaKey, store.Limit{Max: q.Max, TTL: end.Sub(now), Algorithm: store.FixedWindow}, end
+}
+
+// rejectQuota updates result to report the rejection of a request by quota, whose bucket is in state.
+// failed is true when the request was rejected by FailClosed rather than because the quota is exhausted.
+func (l *Limiter) rejectQuota(result *Result, quota Quota, state store.State, failed bool, now time.Time) {
+	start, end := quota.Window(now)
+	result.Allowed = false
+	result.Limit = LimitValue{Max: quota.Max, TTL: end.Sub(start), Algorithm: store.FixedWindow}
+	result.Remaining = state.Remaining
+	result.ResetAt = end
+	result.RetryAfter = end.Sub(now)
+	if failed {
+		result.ResetAt, result.RetryAfter = state.ResetAt, state.RetryAfter
+	}
+	result.Quota = &quota
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aw16com/tollbooth/store"
+)
+
+func TestQuotaWindow(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("time zone database is not available. Error: %v", err)
+	}
+	kolkata, _ := time.LoadLocation("Asia/Kolkata")
+
+	// Thursday 2021-12-30 23:30 UTC is Friday 00:30 in Paris.
+	now := time.Date(2021, 12, 30, 23, 30, 0, 0, time.UTC)
+	cases := []struct {
+		quota Quota
+		start time.Time
+		end   time.Time
+	}{
+		{Quota{Period: Daily}, time.Date(2021, 12, 30, 0, 0, 0, 0, time.UTC), time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{Quota{Period: Daily, Location: paris}, time.Date(2021, 12, 31, 0, 0, 0, 0, paris), time.Date(2022, 1, 1, 0, 0, 0, 0, paris)},
+		{Quota{Period: Hourly, Location: kolkata}, time.Date(2021, 12, 31, 5, 0, 0, 0, kolkata), time.Date(2021, 12, 31, 6, 0, 0, 0, kolkata)},
+		{Quota{Period: Weekly}, time.Date(2021, 12, 27, 0, 0, 0, 0, time.UTC), time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{Quota{Period: Monthly}, time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Quota{Period: Monthly, Location: paris}, time.Date(2021, 12, 1, 0, 0, 0, 0, paris), time.Date(2022, 1, 1, 0, 0, 0, 0, paris)},
+	}
+
+	for _, c := range cases {
+		start, end := c.quota.Window(now)
+		if !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Errorf("%v window in %v is incorrect. Start: %v, End: %v", c.quota.Period, c.quota.Location, start, end)
+		}
+	}
+
+	// Days around daylight saving time changes are not 24 hours long.
+	start, end := Quota{Period: Daily, Location: paris}.Window(time.Date(2021, 3, 28, 12, 0, 0, 0, paris))
+	if end.Sub(start) != 23*time.Hour {
+		t.Errorf("Daily window should follow the time zone. Duration: %v", end.Sub(start))
+	}
+}
+
+func TestQuotaIdleMemory(t *testing.T) {
+	s := store.NewMemoryWithConfig(store.MemoryConfig{IdleTTL: time.Millisecond, CleanupInterval: time.Millisecond})
+	limiter := NewLimiterWithStore(10, time.Millisecond, s)
+	defer limiter.Close()
+	limiter.Quotas = []Quota{{Max: 1, Period: Daily}}
+	key := "TestQuotaIdleMemory"
+
+	if result := limiter.Allow(key, nil); !result.Allowed {
+		t.Fatalf("First request should be allowed by the quota. Result: %+v", result)
+	}
+	<-time.After(20 * time.Millisecond)
+	if result := limiter.Allow(key, nil); result.Allowed || result.Quota == nil {
+		t.Errorf("Quota should survive the sweep of idle buckets. Result: %+v", result)
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	for _, period := range []Period{Hourly, Daily, Weekly, Monthly} {
+		if parsed, err := ParsePeriod(period.String()); err != nil || parsed != period {
+			t.Errorf("%v should parse its own name. Parsed: %v, Error: %v", period, parsed, err)
+		}
+	}
+	if _, err := ParsePeriod("yearly"); err == nil {
+		t.Error("Unknown periods should not parse.")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	limiter := NewLimiter(10, time.Second, nil)
+	defer limiter.Close()
+	limiter.Quotas = []Quota{{Max: 5, Period: Monthly}, {Max: 2, Period: Daily}}
+	key := "TestQuota"
+
+	for i := 0; i < 2; i++ {
+		if result := limiter.Allow(key, nil); !result.Allowed || result.Quota != nil {
+			t.Errorf("N(%v) request should be allowed by the quotas. Result: %+v", i, result)
+		}
+	}
+
+	result := limiter.Allow(key, nil)
+	if result.Allowed || result.Quota == nil || result.Quota.Period != Daily {
+		t.Fatalf("Third request should be rejected by the daily quota. Result: %+v", result)
+	}
+	_, end := Quota{Period: Daily}.Window(time.Now())
+	if !result.ResetAt.Equal(end) || result.RetryAfter <= 0 || result.Limit.Max != 2 {
+		t.Errorf("Result should report the daily quota. Result: %+v", result)
+	}
+
+	usages, err := limiter.QuotaUsage(key)
+	if err != nil {
+		t.Fatalf("QuotaUsage should not fail. Error: %v", err)
+	}
+	if len(usages) != 2 || usages[0].Used != 2 || usages[0].Remaining != 3 || usages[1].Used != 2 {
+		t.Errorf("Rejected requests should not be counted by the other quotas. Usages: %+v", usages)
+	}
+	state, _ := limiter.Store.Peek(context.Background(), key, store.Limit{Max: 10, TTL: time.Second})
+	if state.Remaining != 8 {
+		t.Errorf("Rate limit should give back the request rejected by the quota. Remaining: %v", state.Remaining)
+	}
+}
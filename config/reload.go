@@ -0,0 +1,193 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// RuleDiff reports how the API rate limits of a router changed on reload.
+type RuleDiff struct {
+	Added   []RateLimit
+	Removed []RateLimit
+
+	// Rate limits whose key was registered before with another value or priority, as registered now.
+	Changed []RateLimit
+}
+
+// Empty reports whether nothing changed.
+func (d RuleDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Reload atomically registers rules in place of every registered rate limit and returns what changed.
+// Buckets are kept by the store under request keys, so requests matching a rate limit whose key did not
+// change keep their bucket. Nothing is replaced when one of the rules does not compile.
+func (rt *Router) Reload(rules []RateLimit) (RuleDiff, error) {
+	if rt == nil {
+		return RuleDiff{}, errNilRouter
+	}
+
+	compiled, err := compileRuleSet(rules)
+	if err != nil {
+		return RuleDiff{}, err
+	}
+	return rt.reload(compiled), nil
+}
+
+// ruleSet holds rate limits in matching order, compiled to replace the ones of a router.
+type ruleSet struct {
+	rules []RateLimit
+	table *ruleTable
+}
+
+// compileRuleSet compiles a copy of rules.
+func compileRuleSet(rules []RateLimit) (ruleSet, error) {
+	rules = append([]RateLimit(nil), rules...)
+	table, err := compileRules(rules)
+	if err != nil {
+		return ruleSet{}, err
+	}
+	return ruleSet{rules: rules, table: table}, nil
+}
+
+// reload registers the compiled rules in place of every registered rate limit and returns what changed.
+func (rt *Router) reload(compiled ruleSet) RuleDiff {
+	rt.Lock()
+	defer rt.Unlock()
+
+	previous := make(map[LimitKey]RateLimit, len(rt.rules))
+	for _, rule := range rt.rules {
+		previous[rule.Key] = rule
+	}
+
+	var diff RuleDiff
+	current := make(map[LimitKey]bool, len(compiled.rules))
+	for _, rule := range compiled.rules {
+		current[rule.Key] = true
+		registered, found := previous[rule.Key]
+		switch {
+		case !found:
+			diff.Added = append(diff.Added, rule)
+		case !reflect.DeepEqual(registered, rule):
+			diff.Changed = append(diff.Changed, rule)
+		}
+	}
+	for _, rule := range rt.rules {
+		if !current[rule.Key] {
+			diff.Removed = append(diff.Removed, rule)
+		}
+	}
+
+	rt.rules = compiled.rules
+	rt.table = compiled.table
+	return diff
+}
+
+// Reloader applies the rules of a configuration file to running limiters,
+// on explicit Reload calls or when Watch sees the file change.
+type Reloader struct {
+	// Path of the configuration file.
+	Path string
+
+	// Limiters to reload by the name they have in the configuration file.
+	Limiters map[string]*Limiter
+
+	// Called by Watch after every reload, with the error that prevented it if any.
+	OnReload func(diffs map[string]RuleDiff, err error)
+
+	stop     chan struct{}
+	stopInit sync.Once
+	stopOnce sync.Once
+}
+
+// NewReloader is a constructor for Reloader.
+func NewReloader(path string, limiters map[string]*Limiter) *Reloader {
+	return &Reloader{Path: path, Limiters: limiters}
+}
+
+// Reload reads the configuration file and replaces the rules of every limiter with the ones configured
+// under its name, returning what changed by limiter name. No limiter is changed when the file is invalid
+// or misses one of the limiters. Other limiter settings are only read by LimiterConfig.NewLimiter.
+func (r *Reloader) Reload() (map[string]RuleDiff, error) {
+	conf, err := LoadConfigFile(r.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every limiter's rules are compiled before any is replaced, so that an invalid rule changes nothing.
+	rules := make(map[string]ruleSet, len(r.Limiters))
+	for _, limiterConf := range conf.Limiters {
+		if _, found := r.Limiters[limiterConf.Name]; !found {
+			continue
+		}
+		compiled, err := compileRuleSet(limiterConf.RateLimits())
+		if err != nil {
+			return nil, fmt.Errorf("limiter %q: %w", limiterConf.Name, err)
+		}
+		rules[limiterConf.Name] = compiled
+	}
+	for name := range r.Limiters {
+		if _, found := rules[name]; !found {
+			return nil, fmt.Errorf("limiter %q is missing from %v", name, r.Path)
+		}
+	}
+
+	diffs := make(map[string]RuleDiff, len(rules))
+	for name, compiled := range rules {
+		diffs[name] = r.Limiters[name].rules().reload(compiled)
+	}
+	return diffs, nil
+}
+
+// Watch reloads the configuration file whenever its modification time or size changes,
+// checking every interval until Close is called.
+func (r *Reloader) Watch(interval time.Duration) {
+	modTime, size := fileVersion(r.Path)
+	stop := r.stopped()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				newModTime, newSize := fileVersion(r.Path)
+				if newModTime.Equal(modTime) && newSize == size {
+					continue
+				}
+				modTime, size = newModTime, newSize
+
+				diffs, err := r.Reload()
+				if r.OnReload != nil {
+					r.OnReload(diffs, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops watching the configuration file.
+func (r *Reloader) Close() error {
+	r.stopOnce.Do(func() { close(r.stopped()) })
+	return nil
+}
+
+// stopped returns the channel closed by Close, made on first use so that a Reloader literal works too.
+func (r *Reloader) stopped() chan struct{} {
+	r.stopInit.Do(func() { r.stop = make(chan struct{}) })
+	return r.stop
+}
+
+func fileVersion(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRouterReload(t *testing.T) {
+	rt := NewRouter()
+	rt.Replace([]RateLimit{newRule("/kept", "GET", 1), newRule("/changed", "GET", 1), newRule("/removed", "GET", 1)})
+
+	diff, err := rt.Reload([]RateLimit{newRule("/kept", "GET", 1), newRule("/changed", "GET", 2), newRule("/added", "GET", 1)})
+	if err != nil {
+		t.Fatalf("Reload should succeed. Error: %v", err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].Key.Path != "/added" {
+		t.Errorf("Added rules are incorrect. Added: %+v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Key.Path != "/removed" {
+		t.Errorf("Removed rules are incorrect. Removed: %+v", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Val.Max != 2 {
+		t.Errorf("Changed rules are incorrect. Changed: %+v", diff.Changed)
+	}
+
+	diff, _ = rt.Reload(rt.Rules())
+	if !diff.Empty() {
+		t.Errorf("Reloading the same rules should not change anything. Diff: %+v", diff)
+	}
+
+	if _, err := rt.Reload([]RateLimit{newRule("(", "GET", 1)}); err == nil {
+		t.Error("Reload should fail on an invalid rule.")
+	}
+	if rules := rt.Rules(); len(rules) != 3 {
+		t.Errorf("Failed reload should keep the registered rules. Rules: %+v", rules)
+	}
+}
+
+func writeConfigFile(t *testing.T, path string, ruleMax string) {
+	data := "limiters:\n  - name: api\n    max: 1\n    ttl: 1s\n    rules:\n      - path: /search\n        method: GET\n        max: " + ruleMax + "\n        ttl: 1m\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tollbooth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limits.yaml")
+	writeConfigFile(t, path, "1")
+
+	conf, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiters := conf.NewLimiters()
+	limiter := limiters["api"]
+	defer limiter.Close()
+
+	request, _ := http.NewRequest("GET", "/search", nil)
+	key := "127.0.0.1|/search"
+	limiter.AllowRule(key, limiter.Rules.Match(request))
+
+	writeConfigFile(t, path, "1")
+	reloader := NewReloader(path, limiters)
+	diffs, err := reloader.Reload()
+	if err != nil {
+		t.Fatalf("Reload should succeed. Error: %v", err)
+	}
+	if !diffs["api"].Empty() {
+		t.Errorf("Nothing should have changed. Diff: %+v", diffs["api"])
+	}
+	if result := limiter.AllowRule(key, limiter.Rules.Match(request)); result.Allowed {
+		t.Error("Bucket of an unchanged rule should be kept across reloads.")
+	}
+
+	writeConfigFile(t, path, "5")
+	diffs, _ = reloader.Reload()
+	if len(diffs["api"].Changed) != 1 {
+		t.Errorf("The rule should have changed. Diff: %+v", diffs["api"])
+	}
+	if rule := limiter.Rules.Match(request); rule == nil || rule.Val.Max != 5 {
+		t.Errorf("The new rule should apply. Rule: %+v", rule)
+	}
+
+	ioutil.WriteFile(path, []byte("limiters:\n  - name: other\n    max: 1\n    ttl: 1s\n"), 0644)
+	if _, err := reloader.Reload(); err == nil {
+		t.Error("Reload should fail when a limiter is missing from the file.")
+	}
+	if rule := limiter.Rules.Match(request); rule == nil || rule.Val.Max != 5 {
+		t.Errorf("A failed reload should keep the rules. Rule: %+v", rule)
+	}
+}
+
+func TestReloaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tollbooth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limits.yaml")
+	writeConfigFile(t, path, "1")
+
+	conf, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiters := conf.NewLimiters()
+	defer limiters["api"].Close()
+
+	reloaded := make(chan map[string]RuleDiff, 1)
+	reloader := NewReloader(path, limiters)
+	reloader.OnReload = func(diffs map[string]RuleDiff, err error) {
+		if err != nil {
+			t.Errorf("Watch should reload the file. Error: %v", err)
+		}
+		reloaded <- diffs
+	}
+	reloader.Watch(10 * time.Millisecond)
+	defer reloader.Close()
+
+	writeConfigFile(t, path, "10")
+	select {
+	case diffs := <-reloaded:
+		if len(diffs["api"].Changed) != 1 || diffs["api"].Changed[0].Val.Max != 10 {
+			t.Errorf("Watch should report the changed rule. Diff: %+v", diffs["api"])
+		}
+	case <-time.After(time.Second):
+		t.Error("Watch should have reloaded the changed file.")
+	}
+}
+
+func TestReloaderLimiterLiteral(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tollbooth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "limits.yaml")
+	writeConfigFile(t, path, "2")
+
+	limiter := &Limiter{Max: 1, TTL: time.Second}
+	if _, err := NewReloader(path, map[string]*Limiter{"api": limiter}).Reload(); err != nil {
+		t.Fatalf("Reload should succeed. Error: %v", err)
+	}
+	request, _ := http.NewRequest("GET", "/search", nil)
+	if rule := limiter.Rules.Match(request); rule == nil || rule.Val.Max != 2 {
+		t.Errorf("Rules of a limiter literal should be created on reload. Rule: %+v", rule)
+	}
+}
+
+func TestReloaderLiteral(t *testing.T) {
+	reloader := &Reloader{Path: filepath.Join(os.TempDir(), "tollbooth-missing.yaml")}
+	reloader.Watch(10 * time.Millisecond)
+	reloader.Close()
+	if err := reloader.Close(); err != nil {
+		t.Errorf("Reloader literal should close. Error: %v", err)
+	}
+}
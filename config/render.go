@@ -0,0 +1,147 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Renderer writes the response of a request rejected by limiter.
+// result is nil when the decision was not taken on a bucket.
+type Renderer interface {
+	Render(w http.ResponseWriter, r *http.Request, limiter *Limiter, result *Result)
+}
+
+// RendererFunc is an adapter to use ordinary functions as Renderer.
+type RendererFunc func(w http.ResponseWriter, r *http.Request, limiter *Limiter, result *Result)
+
+// Render calls f(w, r, limiter, result).
+func (f RendererFunc) Render(w http.ResponseWriter, r *http.Request, limiter *Limiter, result *Result) {
+	f(w, r, limiter, result)
+}
+
+// TextRenderer writes limiter.Message as limiter.MessageContentType.
+type TextRenderer struct{}
+
+// Render writes limiter.Message.
+func (TextRenderer) Render(w http.ResponseWriter, r *http.Request, limiter *Limiter, result *Result) {
+	w.Header().Set("Content-Type", limiter.MessageContentType)
+	w.WriteHeader(limiter.StatusCode)
+	w.Write([]byte(limiter.Message))
+}
+
+// JSONRenderer writes limiter.Message and the state of the bucket as application/json.
+type JSONRenderer struct{}
+
+// Render writes a JSON object with message, status, limit, remaining and retry_after fields.
+func (JSONRenderer) Render(w http.ResponseWriter, r *http.Request, limiter *Limiter, result *Result) {
+	body := newLimitBody(limiter, result)
+	body.Message = limiter.Message
+	writeJSON(w, "application/json", limiter.StatusCode, body)
+}
+
+// ProblemRenderer writes the rejection as an RFC 7807 application/problem+json document,
+// extended with the limit, remaining and retry_after members.
+type ProblemRenderer struct{}
+
+// Render writes a problem details object whose detail is limiter.Message.
+func (ProblemRenderer) Render(w http.ResponseWriter, r *http.Request, limiter *Limiter, result *Result) {
+	body := newLimitBody(limiter, result)
+	body.Type = "about:blank"
+	body.Title = http.StatusText(limiter.StatusCode)
+	body.Detail = limiter.Message
+	writeJSON(w, "application/problem+json", limiter.StatusCode, body)
+}
+
+// NegotiatedRenderer picks TextRenderer, JSONRenderer or ProblemRenderer from the Accept header.
+// TextRenderer is used when the request has no preference.
+type NegotiatedRenderer struct{}
+
+// Render delegates to the renderer of the media type preferred by the request.
+func (NegotiatedRenderer) Render(w http.ResponseWriter, r *http.Request, limiter *Limiter, result *Result) {
+	var renderer Renderer = TextRenderer{}
+	switch negotiate(r.Header.Get("Accept"), "text/plain", "application/json", "application/problem+json") {
+	case "application/json":
+		renderer = JSONRenderer{}
+	case "application/problem+json":
+		renderer = ProblemRenderer{}
+	}
+	renderer.Render(w, r, limiter, result)
+}
+
+// limitBody holds the fields of the JSON renderers, Type, Title and Detail are only set for problem details.
+type limitBody struct {
+	Type       string `json:"type,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Limit      *int64 `json:"limit,omitempty"`
+	Remaining  *int64 `json:"remaining,omitempty"`
+	RetryAfter *int64 `json:"retry_after,omitempty"`
+}
+
+func newLimitBody(limiter *Limiter, result *Result) *limitBody {
+	body := &limitBody{Status: limiter.StatusCode}
+	if result != nil {
+		retryAfter := result.RetryAfterSeconds()
+		body.Limit = &result.Limit.Max
+		body.Remaining = &result.Remaining
+		body.RetryAfter = &retryAfter
+	}
+	return body
+}
+
+func writeJSON(w http.ResponseWriter, contentType string, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+// negotiate returns the offer with the highest quality in the accept header.
+// Ties go to the earliest offer, the first offer is returned when accept is empty.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQuality := "", 0.0
+	for _, offer := range offers {
+		if quality := acceptQuality(accept, offer); quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality given to mediaType by the most specific matching range of accept.
+func acceptQuality(accept string, mediaType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		rangeSpecificity := -1
+		switch {
+		case mediaRange == mediaType:
+			rangeSpecificity = 2
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			rangeSpecificity = 1
+		case mediaRange == "*/*":
+			rangeSpecificity = 0
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+
+		specificity, quality = rangeSpecificity, 1
+		for _, param := range params[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.TrimSpace(name) == "q" {
+				quality, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			}
+		}
+	}
+	return quality
+}
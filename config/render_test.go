@@ -0,0 +1,113 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func renderRejection(t *testing.T, renderer Renderer, accept string) *httptest.ResponseRecorder {
+	limiter := NewLimiter(10, time.Second, nil)
+	defer limiter.Close()
+
+	request, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+
+	rr := httptest.NewRecorder()
+	renderer.Render(rr, request, limiter, &Result{
+		Limit:      LimitValue{Max: 10, TTL: time.Second},
+		Remaining:  0,
+		RetryAfter: 1500 * time.Millisecond,
+	})
+	return rr
+}
+
+func TestTextRenderer(t *testing.T) {
+	rr := renderRejection(t, TextRenderer{}, "")
+	if rr.Code != 429 {
+		t.Errorf("Status code is incorrect. Value: %v", rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type should be MessageContentType. Value: %v", got)
+	}
+	if got := rr.Body.String(); got != "You have reached maximum request limit." {
+		t.Errorf("Body should be Message. Value: %v", got)
+	}
+}
+
+func TestJSONRenderer(t *testing.T) {
+	rr := renderRejection(t, JSONRenderer{}, "")
+	if got := rr.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type is incorrect. Value: %v", got)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Body should be JSON. Error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"message":     "You have reached maximum request limit.",
+		"status":      float64(429),
+		"limit":       float64(10),
+		"remaining":   float64(0),
+		"retry_after": float64(2),
+	}
+	for name, value := range expected {
+		if body[name] != value {
+			t.Errorf("Field %v is incorrect. Value: %v, expected: %v", name, body[name], value)
+		}
+	}
+}
+
+func TestProblemRenderer(t *testing.T) {
+	rr := renderRejection(t, ProblemRenderer{}, "")
+	if got := rr.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type is incorrect. Value: %v", got)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Body should be JSON. Error: %v", err)
+	}
+	expected := map[string]interface{}{
+		"type":        "about:blank",
+		"title":       "Too Many Requests",
+		"status":      float64(429),
+		"detail":      "You have reached maximum request limit.",
+		"retry_after": float64(2),
+	}
+	for name, value := range expected {
+		if body[name] != value {
+			t.Errorf("Field %v is incorrect. Value: %v, expected: %v", name, body[name], value)
+		}
+	}
+}
+
+func TestNegotiatedRenderer(t *testing.T) {
+	cases := map[string]string{
+		"":                                    "text/plain; charset=utf-8",
+		"*/*":                                 "text/plain; charset=utf-8",
+		"application/json":                    "application/json",
+		"application/*":                       "application/json",
+		"application/problem+json":            "application/problem+json",
+		"text/html, application/json;q=0.9":   "application/json",
+		"application/json;q=0.5, */*;q=0.1":   "application/json",
+		"application/json;q=0.5, text/plain":  "text/plain; charset=utf-8",
+		"application/problem+json, */*;q=0.8": "application/problem+json",
+		"text/html":                           "text/plain; charset=utf-8",
+	}
+
+	for accept, contentType := range cases {
+		rr := renderRejection(t, NegotiatedRenderer{}, accept)
+		if got := rr.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("Accept %q should be rendered as %v. Value: %v", accept, contentType, got)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aw16com/tollbooth/store"
+)
+
+// MatchType tells how the Path of a LimitKey is compared to request paths.
+type MatchType int
+
+const (
+	// MatchRegexp matches paths containing a match of the regular expression Path.
+	MatchRegexp MatchType = iota
+
+	// MatchExact matches the path equal to Path.
+	MatchExact
+
+	// MatchPrefix matches paths starting with Path.
+	MatchPrefix
+
+	// MatchTemplate matches paths whose segments match the segments of Path,
+	// a {name} segment matching any non-empty segment, as in /users/{id}.
+	MatchTemplate
+)
+
+// anyMethod is the Method of rate limits applying to every HTTP method, as is an empty Method since
+// rules are indexed by Router. Before, an empty Method matched no request.
+const anyMethod = "*"
+
+// errNilRouter is returned when rate limits are registered on a nil Router.
+var errNilRouter = errors.New("rate limits registered on a nil router")
+
+// Router holds API rate limits and finds the one applying to a request.
+// Rate limits are compiled once when registered. It is safe for concurrent use.
+// A nil Router matches no request and fails to register rate limits.
+type Router struct {
+	rules []RateLimit
+	table *ruleTable
+
+	sync.RWMutex
+}
+
+// ruleTable indexes compiled rate limits by method.
+type ruleTable struct {
+	// Exact rate limits by method and path.
+	exact map[string]map[string]*compiledRule
+
+	// Other rate limits by method in matching order, including the ones of anyMethod.
+	patterns map[string][]*compiledRule
+}
+
+type compiledRule struct {
+	rule     RateLimit
+	order    int
+	regexp   *regexp.Regexp
+	segments []string
+}
+
+// NewRouter is a constructor for Router.
+func NewRouter() *Router {
+	return &Router{rules: make([]RateLimit, 0), table: newRuleTable()}
+}
+
+// Add registers rule, replacing the rate limit registered with the same key.
+func (rt *Router) Add(rule RateLimit) error {
+	if rt == nil {
+		return errNilRouter
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	rules := make([]RateLimit, 0, len(rt.rules)+1)
+	for _, registered := range rt.rules {
+		if registered.Key != rule.Key {
+			rules = append(rules, registered)
+		}
+	}
+	return rt.set(append(rules, rule))
+}
+
+// Remove unregisters the rate limit of key and reports whether it was registered.
+func (rt *Router) Remove(key LimitKey) bool {
+	if rt == nil {
+		return false
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	rules := make([]RateLimit, 0, len(rt.rules))
+	for _, registered := range rt.rules {
+		if registered.Key != key {
+			rules = append(rules, registered)
+		}
+	}
+	if len(rules) == len(rt.rules) {
+		return false
+	}
+	rt.set(rules)
+	return true
+}
+
+// Replace registers rules in place of every registered rate limit.
+// Nothing is replaced when one of the rules does not compile.
+func (rt *Router) Replace(rules []RateLimit) error {
+	if rt == nil {
+		return errNilRouter
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	return rt.set(append([]RateLimit(nil), rules...))
+}
+
+// Rules returns the registered rate limits in matching order.
+func (rt *Router) Rules() []RateLimit {
+	if rt == nil {
+		return nil
+	}
+
+	rt.RLock()
+	defer rt.RUnlock()
+
+	return append([]RateLimit(nil), rt.rules...)
+}
+
+// Match returns the rate limit applying to r, nil when none does.
+// Rate limits of higher Priority win, then the ones with the longest Path.
+func (rt *Router) Match(r *http.Request) *RateLimit {
+	if rt == nil {
+		return nil
+	}
+
+	rt.RLock()
+	table := rt.table
+	rt.RUnlock()
+
+	if match := table.match(r.Method, r.URL.Path); match != nil {
+		rule := match.rule
+		return &rule
+	}
+	return nil
+}
+
+// set compiles rules and makes them the registered rate limits.
+func (rt *Router) set(rules []RateLimit) error {
+	table, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+
+	rt.rules = rules
+	rt.table = table
+	return nil
+}
+
+// compileRules sorts rules in matching order and indexes them.
+func compileRules(rules []RateLimit) (*ruleTable, error) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return len(rules[i].Key.Path) > len(rules[j].Key.Path)
+	})
+
+	table := newRuleTable()
+	for i, rule := range rules {
+		compiled, err := compileRule(rule, i)
+		if err != nil {
+			return nil, err
+		}
+		table.add(compiled)
+	}
+	return table, nil
+}
+
+func newRuleTable() *ruleTable {
+	return &ruleTable{
+		exact:    make(map[string]map[string]*compiledRule),
+		patterns: make(map[string][]*compiledRule),
+	}
+}
+
+// add indexes rule, which must come after every rule already added in matching order.
+func (t *ruleTable) add(rule *compiledRule) {
+	method := rule.rule.Key.Method
+	if method == "" {
+		method = anyMethod
+	}
+
+	if rule.rule.Key.Match == MatchExact {
+		if t.exact[method] == nil {
+			t.exact[method] = make(map[string]*compiledRule)
+		}
+		if _, found := t.exact[method][rule.rule.Key.Path]; !found {
+			t.exact[method][rule.rule.Key.Path] = rule
+		}
+		return
+	}
+
+	if method != anyMethod {
+		if _, found := t.patterns[method]; !found {
+			// Method specific lists include the rules of anyMethod registered so far.
+			t.patterns[method] = append([]*compiledRule(nil), t.patterns[anyMethod]...)
+		}
+		t.patterns[method] = append(t.patterns[method], rule)
+		return
+	}
+
+	for m := range t.patterns {
+		t.patterns[m] = append(t.patterns[m], rule)
+	}
+	if _, found := t.patterns[anyMethod]; !found {
+		t.patterns[anyMethod] = []*compiledRule{rule}
+	}
+}
+
+// match returns the first rule in matching order applying to method and path.
+func (t *ruleTable) match(method string, path string) *compiledRule {
+	best := t.exact[method][path]
+	if any := t.exact[anyMethod][path]; any != nil && (best == nil || any.order < best.order) {
+		best = any
+	}
+
+	patterns, found := t.patterns[method]
+	if !found {
+		patterns = t.patterns[anyMethod]
+	}
+	for _, rule := range patterns {
+		if best != nil && rule.order > best.order {
+			break
+		}
+		if rule.matchPath(path) {
+			return rule
+		}
+	}
+	return best
+}
+
+func compileRule(rule RateLimit, order int) (*compiledRule, error) {
+	compiled := &compiledRule{rule: rule, order: order}
+
+	switch rule.Key.Match {
+	case MatchRegexp:
+		re, err := regexp.Compile(rule.Key.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q of %v rate limit: %v", rule.Key.Path, rule.Key.Method, err)
+		}
+		compiled.regexp = re
+	case MatchTemplate:
+		compiled.segments = strings.Split(strings.Trim(rule.Key.Path, "/"), "/")
+	case MatchExact, MatchPrefix:
+	default:
+		return nil, fmt.Errorf("unknown match type %v of %v %v rate limit", rule.Key.Match, rule.Key.Method, rule.Key.Path)
+	}
+
+	return compiled, nil
+}
+
+func (c *compiledRule) matchPath(path string) bool {
+	switch c.rule.Key.Match {
+	case MatchExact:
+		return path == c.rule.Key.Path
+	case MatchPrefix:
+		return strings.HasPrefix(path, c.rule.Key.Path)
+	case MatchTemplate:
+		return matchSegments(c.segments, strings.Trim(path, "/"))
+	default:
+		return c.regexp.MatchString(path)
+	}
+}
+
+// matchSegments reports whether the slash separated segments of path match the template segments.
+func matchSegments(segments []string, path string) bool {
+	for i, segment := range segments {
+		var part string
+		if i == len(segments)-1 {
+			part, path = path, ""
+			if strings.IndexByte(part, '/') >= 0 {
+				return false
+			}
+		} else {
+			idx := strings.IndexByte(path, '/')
+			if idx < 0 {
+				return false
+			}
+			part, path = path[:idx], path[idx+1:]
+		}
+
+		if isVariable(segment) {
+			if part == "" {
+				return false
+			}
+		} else if part != segment {
+			return false
+		}
+	}
+	return true
+}
+
+func isVariable(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+// RegisterAPI registers rate limit for the specified API on the limiter.
+// The path is a regular expression.
+func (l *Limiter) RegisterAPI(path string, method string, max int64, duration time.Duration) {
+	l.RegisterAPIWithAlgorithm(path, method, max, duration, 0)
+}
+
+// RegisterAPIWithAlgorithm is RegisterAPI counting the requests with algorithm.
+func (l *Limiter) RegisterAPIWithAlgorithm(path string, method string, max int64, duration time.Duration, algorithm store.Algorithm) {
+	err := l.rules().Add(RateLimit{
+		Key: LimitKey{
+			Path:   path,
+			Method: method,
+		},
+		Val: LimitValue{
+			Max:       max,
+			TTL:       duration,
+			Algorithm: algorithm,
+		},
+	})
+	if err != nil {
+		log.Println("fail to register rate limit: ", err)
+	}
+}
+
+// rules returns the rules of the limiter, created on first use when a Limiter literal left them nil.
+func (l *Limiter) rules() *Router {
+	l.rulesOnce.Do(func() {
+		if l.Rules == nil {
+			l.Rules = NewRouter()
+		}
+	})
+	return l.Rules
+}
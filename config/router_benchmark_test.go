@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// legacyMatch is the matching of tollbooth before rate limits were compiled.
+func legacyMatch(settings []RateLimit, r *http.Request) *LimitValue {
+	path := r.URL.Path
+	method := r.Method
+	for i, ratelimit := range settings {
+		if ratelimit.Key.Method == method {
+			matched, _ := regexp.MatchString(ratelimit.Key.Path, path)
+			if matched {
+				return &settings[i].Val
+			}
+		}
+	}
+	return nil
+}
+
+func benchmarkRules(n int) []RateLimit {
+	methods := []string{"GET", "POST", "PUT", "DELETE"}
+	rules := make([]RateLimit, 0, n)
+	for i := 0; i < n; i++ {
+		rules = append(rules, RateLimit{
+			Key: LimitKey{Path: fmt.Sprintf("^/api/v1/resource%v/.*", i), Method: methods[i%len(methods)]},
+			Val: LimitValue{Max: 1, TTL: time.Second},
+		})
+	}
+	return rules
+}
+
+func BenchmarkLegacyMatch(b *testing.B) {
+	rt := NewRouter()
+	rt.Replace(benchmarkRules(300))
+	settings := rt.Rules()
+	request, _ := http.NewRequest("GET", "/api/v1/resource296/42", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		legacyMatch(settings, request)
+	}
+}
+
+func BenchmarkRouterMatchRegexp(b *testing.B) {
+	rt := NewRouter()
+	rt.Replace(benchmarkRules(300))
+	request, _ := http.NewRequest("GET", "/api/v1/resource296/42", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.Match(request)
+	}
+}
+
+func BenchmarkRouterMatchTemplate(b *testing.B) {
+	rules := benchmarkRules(300)
+	for i := range rules {
+		rules[i].Key.Path = fmt.Sprintf("/api/v1/resource%v/{id}", i)
+		rules[i].Key.Match = MatchTemplate
+	}
+	rt := NewRouter()
+	rt.Replace(rules)
+	request, _ := http.NewRequest("GET", "/api/v1/resource296/42", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.Match(request)
+	}
+}
+
+func BenchmarkRouterMatchExact(b *testing.B) {
+	rules := benchmarkRules(300)
+	for i := range rules {
+		rules[i].Key.Path = fmt.Sprintf("/api/v1/resource%v", i)
+		rules[i].Key.Match = MatchExact
+	}
+	rt := NewRouter()
+	rt.Replace(rules)
+	request, _ := http.NewRequest("GET", "/api/v1/resource296", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.Match(request)
+	}
+}
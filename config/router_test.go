@@ -0,0 +1,210 @@
+package config
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newRule(path string, method string, max int64) RateLimit {
+	return RateLimit{
+		Key: LimitKey{Path: path, Method: method},
+		Val: LimitValue{Max: max, TTL: time.Second},
+	}
+}
+
+func matchPath(t *testing.T, rt *Router, method string, path string) *RateLimit {
+	request, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt.Match(request)
+}
+
+func TestRouterMatch(t *testing.T) {
+	rt := NewRouter()
+	rt.Add(newRule("/users/.*", "GET", 1))
+	rt.Add(newRule("/users/admin", "GET", 2))
+
+	if rule := matchPath(t, rt, "GET", "/users/admin"); rule == nil || rule.Val.Max != 2 {
+		t.Errorf("The longest matching path should win. Rule: %+v", rule)
+	}
+	if rule := matchPath(t, rt, "GET", "/users/bob"); rule == nil || rule.Val.Max != 1 {
+		t.Errorf("The regular expression should match. Rule: %+v", rule)
+	}
+	if rule := matchPath(t, rt, "POST", "/users/bob"); rule != nil {
+		t.Errorf("Rules of other methods should not match. Rule: %+v", rule)
+	}
+
+	var nilRouter *Router
+	if rule := matchPath(t, nilRouter, "GET", "/users/bob"); rule != nil {
+		t.Errorf("A nil router should not match. Rule: %+v", rule)
+	}
+}
+
+func TestRouterAddRemoveReplace(t *testing.T) {
+	rt := NewRouter()
+	rt.Add(newRule("/a", "GET", 1))
+	rt.Add(newRule("/a", "GET", 5))
+	if rules := rt.Rules(); len(rules) != 1 || rules[0].Val.Max != 5 {
+		t.Errorf("Add should replace the rule of the same key. Rules: %+v", rules)
+	}
+
+	if !rt.Remove(LimitKey{Path: "/a", Method: "GET"}) {
+		t.Error("Remove should report the registered rule.")
+	}
+	if rt.Remove(LimitKey{Path: "/a", Method: "GET"}) {
+		t.Error("Remove should not report an unknown rule.")
+	}
+
+	rt.Replace([]RateLimit{newRule("/b", "GET", 1), newRule("/bb", "GET", 1)})
+	if rules := rt.Rules(); len(rules) != 2 || rules[0].Key.Path != "/bb" {
+		t.Errorf("Replace should register the sorted rules. Rules: %+v", rules)
+	}
+}
+
+func TestRouterConcurrency(t *testing.T) {
+	rt := NewRouter()
+	request, err := http.NewRequest("GET", "/concurrent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			rt.Add(newRule("/concurrent", "GET", int64(i)))
+			rt.Remove(LimitKey{Path: "/other", Method: "GET"})
+		}(i)
+		go func() {
+			defer wg.Done()
+			rt.Match(request)
+		}()
+	}
+	wg.Wait()
+
+	if rules := rt.Rules(); len(rules) != 1 {
+		t.Errorf("Concurrent Add of the same key should keep one rule. Rules: %+v", rules)
+	}
+}
+
+func TestLimiterRegisterAPI(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	other := NewLimiter(1, time.Second, nil)
+	defer other.Close()
+
+	limiter.RegisterAPI("/expensive", "POST", 3, time.Minute)
+
+	if rule := matchPath(t, limiter.Rules, "POST", "/expensive"); rule == nil || rule.Val.Max != 3 {
+		t.Errorf("Rule should be registered on the limiter. Rule: %+v", rule)
+	}
+	if rule := matchPath(t, other.Rules, "POST", "/expensive"); rule != nil {
+		t.Errorf("Rule should not be shared with other limiters. Rule: %+v", rule)
+	}
+}
+
+func TestLimiterLiteralRules(t *testing.T) {
+	limiter := &Limiter{Max: 1, TTL: time.Second}
+	limiter.RegisterAPI("/expensive", "POST", 3, time.Minute)
+	if rule := matchPath(t, limiter.Rules, "POST", "/expensive"); rule == nil || rule.Val.Max != 3 {
+		t.Errorf("Rules of a limiter literal should be created on first use. Rule: %+v", rule)
+	}
+
+	var rt *Router
+	if err := rt.Add(newRule("/a", "GET", 1)); err == nil {
+		t.Error("Registering a rate limit on a nil router should fail.")
+	}
+	if _, err := rt.Reload(nil); err == nil {
+		t.Error("Reloading a nil router should fail.")
+	}
+	if rt.Remove(LimitKey{Path: "/a"}) || rt.Rules() != nil {
+		t.Error("A nil router should have no rate limit.")
+	}
+}
+
+func TestRouterMatchTypes(t *testing.T) {
+	rt := NewRouter()
+	rules := []RateLimit{
+		{Key: LimitKey{Path: "/health", Method: "GET", Match: MatchExact}, Val: LimitValue{Max: 1}},
+		{Key: LimitKey{Path: "/static/", Method: "GET", Match: MatchPrefix}, Val: LimitValue{Max: 2}},
+		{Key: LimitKey{Path: "/users/{id}/posts", Method: "*", Match: MatchTemplate}, Val: LimitValue{Max: 3}},
+		{Key: LimitKey{Path: "^/v[0-9]+/", Method: "GET"}, Val: LimitValue{Max: 4}},
+	}
+	if err := rt.Replace(rules); err != nil {
+		t.Fatalf("Rules should compile. Error: %v", err)
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		max    int64
+	}{
+		{"GET", "/health", 1},
+		{"GET", "/healthz", 0},
+		{"GET", "/static/app.js", 2},
+		{"GET", "/stat", 0},
+		{"GET", "/users/42/posts", 3},
+		{"DELETE", "/users/42/posts", 3},
+		{"GET", "/users/42/posts/1", 0},
+		{"GET", "/users//posts", 0},
+		{"GET", "/v2/users", 4},
+		{"POST", "/v2/users", 0},
+	}
+	for _, c := range cases {
+		rule := matchPath(t, rt, c.method, c.path)
+		if c.max == 0 && rule != nil {
+			t.Errorf("%v %v should not match. Rule: %+v", c.method, c.path, rule)
+		}
+		if c.max != 0 && (rule == nil || rule.Val.Max != c.max) {
+			t.Errorf("%v %v should match the rule of max %v. Rule: %+v", c.method, c.path, c.max, rule)
+		}
+	}
+}
+
+// TestRouterEmptyMethod pins that an empty method matches every method, like "*". Rules registered
+// with an empty method matched no request before the router.
+func TestRouterEmptyMethod(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.RegisterAPI("/upload", "", 3, time.Minute)
+
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		if rule := matchPath(t, limiter.Rules, method, "/upload"); rule == nil || rule.Val.Max != 3 {
+			t.Errorf("Rule without method should match %v requests. Rule: %+v", method, rule)
+		}
+	}
+}
+
+func TestRouterPriority(t *testing.T) {
+	rt := NewRouter()
+	rt.Add(RateLimit{Key: LimitKey{Path: "/api/users/me", Method: "GET", Match: MatchExact}, Val: LimitValue{Max: 1}})
+	rt.Add(RateLimit{Key: LimitKey{Path: "/api/", Method: "", Match: MatchPrefix}, Val: LimitValue{Max: 2}, Priority: 10})
+
+	if rule := matchPath(t, rt, "GET", "/api/users/me"); rule == nil || rule.Val.Max != 2 {
+		t.Errorf("The rule of higher priority should win over a longer exact path. Rule: %+v", rule)
+	}
+
+	rt.Add(RateLimit{Key: LimitKey{Path: "/api/users/me", Method: "GET", Match: MatchExact}, Val: LimitValue{Max: 1}, Priority: 20})
+	if rule := matchPath(t, rt, "GET", "/api/users/me"); rule == nil || rule.Val.Max != 1 {
+		t.Errorf("The exact rule of higher priority should win. Rule: %+v", rule)
+	}
+}
+
+func TestRouterInvalidRule(t *testing.T) {
+	rt := NewRouter()
+	rt.Add(newRule("/valid", "GET", 1))
+
+	if err := rt.Add(newRule("/invalid/(", "GET", 1)); err == nil {
+		t.Error("Add should fail on an invalid regular expression.")
+	}
+	if err := rt.Replace([]RateLimit{newRule("/other", "GET", 1), newRule("[", "GET", 1)}); err == nil {
+		t.Error("Replace should fail on an invalid regular expression.")
+	}
+	if rules := rt.Rules(); len(rules) != 1 || rules[0].Key.Path != "/valid" {
+		t.Errorf("Failed registrations should keep the registered rules. Rules: %+v", rules)
+	}
+}
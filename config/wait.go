@@ -0,0 +1,61 @@
+package config
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Wait is Allow delaying the request until its token is available rather than rejecting it,
+// for at most MaxWait and as long as ctx is not done. The request is rejected at once when its
+// token won't be available in time, or when MaxQueue requests are already waiting.
+func (l *Limiter) Wait(ctx context.Context, key string, limitVal *LimitValue) *Result {
+	return l.decide(l.wait(ctx, key, limitVal, nil, 1))
+}
+
+// WaitRuleN is Wait limited by the value of rule, or by the limiter defaults when rule is nil,
+// taking n tokens at once.
+func (l *Limiter) WaitRuleN(ctx context.Context, key string, rule *RateLimit, n int64) *Result {
+	if rule == nil {
+		return l.decide(l.wait(ctx, key, nil, nil, n))
+	}
+	return l.decide(l.wait(ctx, key, &rule.Val, rule, n))
+}
+
+func (l *Limiter) wait(ctx context.Context, key string, limitVal *LimitValue, rule *RateLimit, n int64) *Result {
+	start := time.Now()
+	result := l.take(ctx, key, limitVal, rule, n)
+	if result.Allowed || l.MaxWait <= 0 {
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.MaxWait)
+	defer cancel()
+
+	waiting := atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	if l.MaxQueue > 0 && waiting > l.MaxQueue {
+		return result
+	}
+
+	for !result.Allowed {
+		deadline, _ := ctx.Deadline()
+		if result.RetryAfter <= 0 || time.Until(deadline) < result.RetryAfter {
+			break
+		}
+
+		timer := time.NewTimer(result.RetryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			result.Waited = time.Since(start)
+			return result
+		case <-timer.C:
+		}
+
+		result = l.take(ctx, key, limitVal, rule, n)
+	}
+
+	result.Waited = time.Since(start)
+	return result
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	limiter := NewLimiter(1, 50*time.Millisecond, nil)
+	defer limiter.Close()
+	limiter.MaxWait = time.Second
+	key := "TestWait"
+
+	limiter.Allow(key, nil)
+	result := limiter.Wait(context.Background(), key, nil)
+	if !result.Allowed {
+		t.Fatalf("Request should be allowed once its token is refilled. Result: %+v", result)
+	}
+	if result.Waited < 40*time.Millisecond || result.Waited > time.Second {
+		t.Errorf("Request should wait for its token. Waited: %v", result.Waited)
+	}
+}
+
+func TestWaitTooLong(t *testing.T) {
+	limiter := NewLimiter(1, time.Minute, nil)
+	defer limiter.Close()
+	limiter.MaxWait = 100 * time.Millisecond
+	key := "TestWaitTooLong"
+
+	limiter.Allow(key, nil)
+	start := time.Now()
+	if result := limiter.Wait(context.Background(), key, nil); result.Allowed {
+		t.Errorf("Request should be rejected when its token is not available within MaxWait. Result: %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Request should be rejected without waiting. Elapsed: %v", elapsed)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	limiter := NewLimiter(1, 500*time.Millisecond, nil)
+	defer limiter.Close()
+	limiter.MaxWait = time.Second
+	key := "TestWaitCanceled"
+
+	limiter.Allow(key, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if result := limiter.Wait(ctx, key, nil); result.Allowed {
+		t.Errorf("Request should be rejected when its context is done. Result: %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Waiting should stop with the context. Elapsed: %v", elapsed)
+	}
+}
+
+func TestWaitMaxQueue(t *testing.T) {
+	limiter := NewLimiter(1, 100*time.Millisecond, nil)
+	defer limiter.Close()
+	limiter.MaxWait = time.Second
+	limiter.MaxQueue = 1
+	key := "TestWaitMaxQueue"
+
+	limiter.Allow(key, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		limiter.Wait(context.Background(), key, nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	result := limiter.Wait(context.Background(), key, nil)
+	if result.Allowed || result.Waited != 0 {
+		t.Errorf("Request should be rejected at once when the queue is full. Result: %+v", result)
+	}
+	wg.Wait()
+}
@@ -2,13 +2,15 @@ module github.com/aw16com/tollbooth
 
 go 1.18
 
-require github.com/aw16com/rate v0.0.1
+require (
+	github.com/aw16com/rate v0.0.1
+	github.com/go-redis/redis v6.15.9+incompatible
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/go-redis/redis v6.15.9+incompatible // indirect
 	github.com/nxadm/tail v1.4.8 // indirect
 	golang.org/x/net v0.0.0-20220225172249-27dd8689420f // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
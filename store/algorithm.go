@@ -0,0 +1,461 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Algorithm selects how a Limit admits requests.
+type Algorithm int
+
+const (
+	// TokenBucket refills one token per TTL up to Max. It is used when no algorithm is set.
+	// Memory refills continuously while Redis, like github.com/aw16com/rate/redis, adds the tokens
+	// of a second once it has elapsed, so a bucket may run out in Redis and not in Memory.
+	TokenBucket Algorithm = iota + 1
+
+	// SlidingWindowLog allows Max requests in any window of TTL.
+	// It keeps the time of every allowed request, up to Max per key.
+	SlidingWindowLog
+
+	// SlidingWindowCounter approximates SlidingWindowLog with the counts of the current
+	// and previous windows of TTL, the previous one weighted by its overlap with the sliding window.
+	SlidingWindowCounter
+
+	// GCRA is the generic cell rate algorithm. It admits the same requests as TokenBucket
+	// but keeps a single timestamp per key, the theoretical arrival time of the next request.
+	GCRA
+
+	// FixedWindow allows Max requests in a window that starts with the first request and lasts TTL.
+	// Quotas aligned on calendar periods pass the time left until the end of the period as TTL.
+	FixedWindow
+)
+
+var algorithmNames = map[Algorithm]string{
+	TokenBucket:          "token_bucket",
+	SlidingWindowLog:     "sliding_window_log",
+	SlidingWindowCounter: "sliding_window_counter",
+	GCRA:                 "gcra",
+	FixedWindow:          "fixed_window",
+}
+
+// String returns the name of the algorithm as accepted by ParseAlgorithm.
+func (a Algorithm) String() string {
+	if name, found := algorithmNames[a]; found {
+		return name
+	}
+	return fmt.Sprintf("Algorithm(%d)", int(a))
+}
+
+// ParseAlgorithm returns the algorithm of the given name.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for algorithm, algorithmName := range algorithmNames {
+		if algorithmName == name {
+			return algorithm, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rate-limit algorithm %q", name)
+}
+
+// algorithm returns the algorithm of limit, TokenBucket when none is set.
+func (l Limit) algorithm() Algorithm {
+	if l.Algorithm == 0 {
+		return TokenBucket
+	}
+	return l.Algorithm
+}
+
+// bucketState is the state kept for a key by the Memory store.
+type bucketState interface {
+	// take consumes n requests when they are allowed at now.
+	take(limit Limit, n int64, now time.Time) State
+
+	// peek reports whether one request would be allowed at now.
+	peek(limit Limit, now time.Time) State
+
+	// refund gives back n requests taken at now, as far as the algorithm allows.
+	refund(limit Limit, n int64, now time.Time)
+
+	// expiry returns when the state becomes equivalent to a new one.
+	expiry(limit Limit) time.Time
+}
+
+func newBucketState(limit Limit, now time.Time) bucketState {
+	switch limit.algorithm() {
+	case SlidingWindowLog:
+		return &slidingLog{}
+	case SlidingWindowCounter:
+		return &slidingCounter{}
+	case GCRA:
+		return &gcra{}
+	case FixedWindow:
+		return &fixedWindow{}
+	default:
+		return &tokenBucket{tokens: float64(limit.Max), last: now}
+	}
+}
+
+// tokenBucket is refilled with one token per TTL up to Max.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(limit Limit, n int64, now time.Time) State {
+	b.tokens = b.refilled(limit, now)
+	if now.After(b.last) {
+		b.last = now
+	}
+
+	allowed := b.tokens >= float64(n)
+	if allowed {
+		b.tokens -= float64(n)
+	}
+	return tokenBucketState(allowed, b.tokens, limit, n, now)
+}
+
+func (b *tokenBucket) peek(limit Limit, now time.Time) State {
+	tokens := b.refilled(limit, now)
+	return tokenBucketState(tokens >= 1, tokens, limit, 1, now)
+}
+
+func (b *tokenBucket) refund(limit Limit, n int64, now time.Time) {
+	b.tokens = math.Min(b.tokens+float64(n), float64(limit.Max))
+}
+
+func (b *tokenBucket) expiry(limit Limit) time.Time {
+	return b.last.Add(refillDuration(float64(limit.Max)-b.tokens, limit))
+}
+
+// refilled returns the tokens of the bucket at now, capped by limit.Max.
+func (b *tokenBucket) refilled(limit Limit, now time.Time) float64 {
+	tokens := b.tokens
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		tokens += float64(elapsed) / float64(limit.TTL)
+	}
+	return math.Min(tokens, float64(limit.Max))
+}
+
+// tokenBucketState returns the state of a token bucket holding tokens at now after a request of n tokens.
+func tokenBucketState(allowed bool, tokens float64, limit Limit, n int64, now time.Time) State {
+	state := State{
+		Allowed:   allowed,
+		Remaining: int64(math.Floor(tokens)),
+		ResetAt:   now.Add(refillDuration(float64(limit.Max)-tokens, limit)),
+	}
+	if !allowed {
+		state.RetryAfter = refillDuration(float64(n)-tokens, limit)
+	}
+	return state
+}
+
+// refillDuration returns the time needed to refill the given number of tokens.
+func refillDuration(tokens float64, limit Limit) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens * float64(limit.TTL)))
+}
+
+// slidingLog keeps the times of the requests allowed within the last TTL, oldest first.
+type slidingLog struct {
+	times []time.Time
+}
+
+func (l *slidingLog) take(limit Limit, n int64, now time.Time) State {
+	l.prune(limit, now)
+
+	count := int64(len(l.times))
+	allowed := count+n <= limit.Max
+	if allowed {
+		for i := int64(0); i < n; i++ {
+			l.times = append(l.times, now)
+		}
+	}
+	return l.state(allowed, limit, n, now)
+}
+
+func (l *slidingLog) peek(limit Limit, now time.Time) State {
+	l.prune(limit, now)
+	return l.state(int64(len(l.times))+1 <= limit.Max, limit, 1, now)
+}
+
+func (l *slidingLog) refund(limit Limit, n int64, now time.Time) {
+	if n > int64(len(l.times)) {
+		n = int64(len(l.times))
+	}
+	l.times = l.times[:int64(len(l.times))-n]
+}
+
+func (l *slidingLog) expiry(limit Limit) time.Time {
+	if len(l.times) == 0 {
+		return time.Time{}
+	}
+	return l.times[len(l.times)-1].Add(limit.TTL)
+}
+
+// prune drops the times that left the window ending at now.
+func (l *slidingLog) prune(limit Limit, now time.Time) {
+	start := now.Add(-limit.TTL)
+	i := 0
+	for i < len(l.times) && !l.times[i].After(start) {
+		i++
+	}
+	l.times = append(l.times[:0], l.times[i:]...)
+}
+
+func (l *slidingLog) state(allowed bool, limit Limit, n int64, now time.Time) State {
+	count := int64(len(l.times))
+	var released, newest time.Time
+	if count > 0 {
+		newest = l.times[count-1]
+		released = newest
+		if needed := count + n - limit.Max; needed > 0 && needed <= count {
+			released = l.times[needed-1]
+		}
+	}
+	return slidingLogState(allowed, count, released, newest, limit, now)
+}
+
+// slidingLogState returns the state of a sliding log holding count requests at now, the newest at newest.
+// released is the request whose expiry lets the last request in, or the newest one when none can.
+func slidingLogState(allowed bool, count int64, released time.Time, newest time.Time, limit Limit, now time.Time) State {
+	state := State{
+		Allowed:   allowed,
+		Remaining: limit.Max - count,
+		ResetAt:   now,
+	}
+	if state.Remaining < 0 {
+		state.Remaining = 0
+	}
+	if count > 0 {
+		state.ResetAt = newest.Add(limit.TTL)
+	}
+	if !allowed && count > 0 {
+		state.RetryAfter = released.Add(limit.TTL).Sub(now)
+	}
+	return state
+}
+
+// slidingCounter counts the requests of the current fixed window of TTL and of the previous one.
+type slidingCounter struct {
+	window time.Time
+	prev   int64
+	curr   int64
+}
+
+func (c *slidingCounter) take(limit Limit, n int64, now time.Time) State {
+	c.advance(limit, now)
+
+	allowed := slidingEstimate(c.prev, c.curr, c.window, limit, now)+float64(n) <= float64(limit.Max)
+	if allowed {
+		c.curr += n
+	}
+	return slidingCounterState(allowed, c.prev, c.curr, c.window, limit, n, now)
+}
+
+func (c *slidingCounter) peek(limit Limit, now time.Time) State {
+	c.advance(limit, now)
+
+	allowed := slidingEstimate(c.prev, c.curr, c.window, limit, now)+1 <= float64(limit.Max)
+	return slidingCounterState(allowed, c.prev, c.curr, c.window, limit, 1, now)
+}
+
+func (c *slidingCounter) refund(limit Limit, n int64, now time.Time) {
+	c.curr -= n
+	if c.curr < 0 {
+		c.curr = 0
+	}
+}
+
+func (c *slidingCounter) expiry(limit Limit) time.Time {
+	switch {
+	case c.curr > 0:
+		return c.window.Add(2 * limit.TTL)
+	case c.prev > 0:
+		return c.window.Add(limit.TTL)
+	default:
+		return time.Time{}
+	}
+}
+
+// advance moves the counter to the window containing now.
+func (c *slidingCounter) advance(limit Limit, now time.Time) {
+	window := windowStart(now, limit.TTL)
+	switch {
+	case window.Equal(c.window):
+	case window.Equal(c.window.Add(limit.TTL)):
+		c.prev, c.curr = c.curr, 0
+	case window.After(c.window):
+		c.prev, c.curr = 0, 0
+	default:
+		// The clock went back, keep counting in the current window.
+		return
+	}
+	c.window = window
+}
+
+// windowStart returns the start of the window of ttl containing now, windows being aligned on the Unix epoch.
+func windowStart(now time.Time, ttl time.Duration) time.Time {
+	nanos := now.UnixNano()
+	return time.Unix(0, nanos-nanos%int64(ttl))
+}
+
+// slidingEstimate returns the number of requests in the sliding window ending at now.
+func slidingEstimate(prev int64, curr int64, window time.Time, limit Limit, now time.Time) float64 {
+	weight := 1 - float64(now.Sub(window))/float64(limit.TTL)
+	return float64(prev)*weight + float64(curr)
+}
+
+// slidingCounterState returns the state of a sliding counter whose current window starts at window.
+func slidingCounterState(allowed bool, prev int64, curr int64, window time.Time, limit Limit, n int64, now time.Time) State {
+	estimate := slidingEstimate(prev, curr, window, limit, now)
+	state := State{
+		Allowed:   allowed,
+		Remaining: int64(math.Floor(float64(limit.Max) - estimate)),
+		ResetAt:   now,
+	}
+	if state.Remaining < 0 {
+		state.Remaining = 0
+	}
+	switch {
+	case curr > 0:
+		state.ResetAt = window.Add(2 * limit.TTL)
+	case prev > 0:
+		state.ResetAt = window.Add(limit.TTL)
+	}
+
+	if !allowed {
+		ttl := float64(limit.TTL)
+		elapsed := float64(now.Sub(window))
+		if room := float64(limit.Max - curr - n); room >= 0 && prev > 0 {
+			// The previous window weighs little enough later in the current one.
+			state.RetryAfter = time.Duration(math.Ceil(ttl*(1-room/float64(prev)) - elapsed))
+		} else {
+			// The current window has to become the previous one.
+			state.RetryAfter = time.Duration(math.Ceil(ttl - elapsed))
+			if room := float64(limit.Max - n); curr > 0 && room < float64(curr) {
+				state.RetryAfter += time.Duration(math.Ceil(ttl * (1 - room/float64(curr))))
+			}
+		}
+		if state.RetryAfter < 0 {
+			state.RetryAfter = 0
+		}
+	}
+	return state
+}
+
+// gcra keeps the theoretical arrival time of the next request, TTL after the previous one.
+// A request is allowed when it arrives at most Max TTLs ahead of its theoretical time.
+type gcra struct {
+	tat time.Time
+}
+
+func (g *gcra) take(limit Limit, n int64, now time.Time) State {
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+
+	next := tat.Add(time.Duration(n) * limit.TTL)
+	allowed := !next.After(now.Add(gcraBurst(limit)))
+	if allowed {
+		g.tat = next
+	}
+	return gcraState(allowed, g.tat, limit, n, now)
+}
+
+func (g *gcra) peek(limit Limit, now time.Time) State {
+	allowed := !maxTime(g.tat, now).Add(limit.TTL).After(now.Add(gcraBurst(limit)))
+	return gcraState(allowed, g.tat, limit, 1, now)
+}
+
+func (g *gcra) refund(limit Limit, n int64, now time.Time) {
+	g.tat = g.tat.Add(-time.Duration(n) * limit.TTL)
+}
+
+func (g *gcra) expiry(limit Limit) time.Time {
+	return g.tat
+}
+
+// gcraBurst returns how far ahead of its theoretical arrival time a request may arrive.
+func gcraBurst(limit Limit) time.Duration {
+	return time.Duration(limit.Max) * limit.TTL
+}
+
+// gcraState returns the state of a key whose theoretical arrival time is tat after a request of n at now.
+func gcraState(allowed bool, tat time.Time, limit Limit, n int64, now time.Time) State {
+	tat = maxTime(tat, now)
+	state := State{
+		Allowed:   allowed,
+		Remaining: int64(now.Add(gcraBurst(limit)).Sub(tat) / limit.TTL),
+		ResetAt:   tat,
+	}
+	if state.Remaining < 0 {
+		state.Remaining = 0
+	}
+	if !allowed {
+		state.RetryAfter = tat.Add(time.Duration(n) * limit.TTL).Add(-gcraBurst(limit)).Sub(now)
+	}
+	return state
+}
+
+// fixedWindow counts the requests of a window ending at end.
+type fixedWindow struct {
+	count int64
+	end   time.Time
+}
+
+func (w *fixedWindow) take(limit Limit, n int64, now time.Time) State {
+	if !now.Before(w.end) {
+		w.count, w.end = 0, now.Add(limit.TTL)
+	}
+
+	allowed := w.count+n <= limit.Max
+	if allowed {
+		w.count += n
+	}
+	return fixedWindowState(allowed, w.count, w.end, limit, n, now)
+}
+
+func (w *fixedWindow) peek(limit Limit, now time.Time) State {
+	if !now.Before(w.end) {
+		return fixedWindowState(limit.Max >= 1, 0, now.Add(limit.TTL), limit, 1, now)
+	}
+	return fixedWindowState(w.count+1 <= limit.Max, w.count, w.end, limit, 1, now)
+}
+
+func (w *fixedWindow) refund(limit Limit, n int64, now time.Time) {
+	w.count -= n
+	if w.count < 0 {
+		w.count = 0
+	}
+}
+
+func (w *fixedWindow) expiry(limit Limit) time.Time {
+	return w.end
+}
+
+// fixedWindowState returns the state of a window ending at end holding count requests at now.
+func fixedWindowState(allowed bool, count int64, end time.Time, limit Limit, n int64, now time.Time) State {
+	state := State{
+		Allowed:   allowed,
+		Remaining: limit.Max - count,
+		ResetAt:   end,
+	}
+	if state.Remaining < 0 {
+		state.Remaining = 0
+	}
+	if !allowed {
+		state.RetryAfter = end.Sub(now)
+	}
+	return state
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingWindowLog, SlidingWindowCounter, GCRA, FixedWindow} {
+		parsed, err := ParseAlgorithm(algorithm.String())
+		if err != nil || parsed != algorithm {
+			t.Errorf("%v should parse its own name. Parsed: %v, Error: %v", algorithm, parsed, err)
+		}
+	}
+
+	if _, err := ParseAlgorithm("leaky_bucket"); err == nil {
+		t.Error("Unknown algorithms should not parse.")
+	}
+}
+
+func TestSlidingWindowLog(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 3, TTL: time.Second, Algorithm: SlidingWindowLog}
+	key := "TestSlidingWindowLog"
+
+	for i := 0; i < 3; i++ {
+		state, _ := s.Take(ctx, key, limit, 1)
+		if !state.Allowed {
+			t.Errorf("N(%v) take should be allowed.", i)
+		}
+		if state.Remaining != int64(2-i) {
+			t.Errorf("N(%v) take left the wrong number of requests. Remaining: %v", i, state.Remaining)
+		}
+		advance(300 * time.Millisecond)
+	}
+
+	state, _ := s.Take(ctx, key, limit, 1)
+	if state.Allowed {
+		t.Error("Fourth take should not be allowed within the window.")
+	}
+	if state.RetryAfter != 100*time.Millisecond {
+		t.Errorf("Retry should be possible once the first request leaves the window. RetryAfter: %v", state.RetryAfter)
+	}
+
+	advance(100 * time.Millisecond)
+	if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+		t.Error("Take should be allowed once the first request left the window.")
+	}
+	if state, _ := s.Take(ctx, key, limit, 1); state.Allowed {
+		t.Error("Only the request that left the window should be replaced.")
+	}
+}
+
+func TestSlidingWindowLogBoundary(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	key := "TestSlidingWindowLogBoundary"
+
+	// A token bucket refilled at the end of the window lets a second burst through, a sliding log does not.
+	bucket := Limit{Max: 3, TTL: time.Second / 3}
+	log := Limit{Max: 3, TTL: time.Second, Algorithm: SlidingWindowLog}
+
+	advance(900 * time.Millisecond)
+	s.Take(ctx, key+"bucket", bucket, 3)
+	s.Take(ctx, key+"log", log, 3)
+
+	advance(time.Second)
+	if state, _ := s.Take(ctx, key+"bucket", bucket, 3); !state.Allowed {
+		t.Error("The token bucket should be refilled after a second.")
+	}
+	if state, _ := s.Take(ctx, key+"log", log, 3); !state.Allowed {
+		t.Error("The sliding log should allow a burst once the previous one left the window.")
+	}
+
+	advance(500 * time.Millisecond)
+	if state, _ := s.Take(ctx, key+"log", log, 1); state.Allowed {
+		t.Error("The sliding log should not allow more than Max requests in any window.")
+	}
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 4, TTL: time.Second, Algorithm: SlidingWindowCounter}
+	key := "TestSlidingWindowCounter"
+
+	if state, _ := s.Take(ctx, key, limit, 4); !state.Allowed || state.Remaining != 0 {
+		t.Errorf("Take of Max requests should be allowed. State: %+v", state)
+	}
+
+	state, _ := s.Take(ctx, key, limit, 1)
+	if state.Allowed {
+		t.Error("Take should not be allowed once Max requests were counted.")
+	}
+	if state.RetryAfter != 1250*time.Millisecond {
+		t.Errorf("Retry should be possible once the previous window weighs 3 requests. RetryAfter: %v", state.RetryAfter)
+	}
+
+	advance(1250 * time.Millisecond)
+	if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+		t.Error("Take should be allowed once the previous window weighs 3 requests.")
+	}
+
+	state, _ = s.Take(ctx, key, limit, 1)
+	if state.Allowed {
+		t.Error("Take should not be allowed while the previous window weighs 3 requests.")
+	}
+	if state.RetryAfter != 250*time.Millisecond {
+		t.Errorf("Retry should be possible once the previous window weighs 2 requests. RetryAfter: %v", state.RetryAfter)
+	}
+
+	advance(2 * time.Second)
+	if state, _ := s.Peek(ctx, key, limit); state.Remaining != 4 {
+		t.Errorf("Counter should be empty after two windows. Remaining: %v", state.Remaining)
+	}
+}
+
+func TestGCRA(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 2, TTL: time.Second, Algorithm: GCRA}
+	key := "TestGCRA"
+
+	for i := 0; i < 2; i++ {
+		state, _ := s.Take(ctx, key, limit, 1)
+		if !state.Allowed || state.Remaining != int64(1-i) {
+			t.Errorf("N(%v) take should be allowed. State: %+v", i, state)
+		}
+	}
+
+	advance(300 * time.Millisecond)
+	state, _ := s.Take(ctx, key, limit, 1)
+	if state.Allowed {
+		t.Error("Third take should not be allowed before one TTL.")
+	}
+	if state.RetryAfter != 700*time.Millisecond {
+		t.Errorf("RetryAfter should be exact. RetryAfter: %v", state.RetryAfter)
+	}
+	if state.ResetAt.Sub(time.Unix(1500000000, 0)) != 2*time.Second {
+		t.Errorf("ResetAt should be the theoretical arrival time. ResetAt: %v", state.ResetAt)
+	}
+
+	advance(state.RetryAfter)
+	if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+		t.Error("Take should be allowed after RetryAfter.")
+	}
+}
+
+// TestGCRAMatchesTokenBucket replays the same requests on both algorithms, which should take the same decisions.
+func TestGCRAMatchesTokenBucket(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	bucket := Limit{Max: 5, TTL: 200 * time.Millisecond}
+	cell := Limit{Max: 5, TTL: 200 * time.Millisecond, Algorithm: GCRA}
+
+	steps := []time.Duration{0, 0, 10, 50, 0, 0, 0, 100, 150, 200, 0, 0, 400, 30, 30, 30, 1000, 0, 0, 0, 0, 0, 0, 70, 130}
+	for i, step := range steps {
+		advance(step * time.Millisecond)
+		n := int64(1 + i%2)
+
+		expected, _ := s.Take(ctx, "TestGCRAMatchesTokenBucket.bucket", bucket, n)
+		state, _ := s.Take(ctx, "TestGCRAMatchesTokenBucket.gcra", cell, n)
+		if state.Allowed != expected.Allowed {
+			t.Errorf("N(%v) GCRA decision differs from the token bucket. GCRA: %+v, token bucket: %+v", i, state, expected)
+		}
+		// The token bucket counts fractions of tokens in floating point, GCRA is exact.
+		if !expected.Allowed && state.RetryAfter != expected.RetryAfter.Round(time.Millisecond) {
+			t.Errorf("N(%v) GCRA RetryAfter differs from the token bucket. GCRA: %v, token bucket: %v", i, state.RetryAfter, expected.RetryAfter)
+		}
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 2, TTL: time.Hour, Algorithm: FixedWindow}
+	key := "TestFixedWindow"
+
+	s.Take(ctx, key, limit, 2)
+	advance(30 * time.Minute)
+
+	// Quotas pass the time left in their period, the window keeps its end.
+	state, _ := s.Take(ctx, key, Limit{Max: 2, TTL: 30 * time.Minute, Algorithm: FixedWindow}, 1)
+	if state.Allowed || state.RetryAfter != 30*time.Minute {
+		t.Errorf("Take should wait for the end of the window. State: %+v", state)
+	}
+
+	advance(30 * time.Minute)
+	if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed || state.Remaining != 1 {
+		t.Errorf("A new window should start at the end of the previous one. State: %+v", state)
+	}
+}
+
+func TestMemoryRefund(t *testing.T) {
+	s, _ := newTestMemory()
+	ctx := context.Background()
+
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingWindowLog, SlidingWindowCounter, GCRA, FixedWindow} {
+		key := "TestMemoryRefund" + algorithm.String()
+		limit := Limit{Max: 2, TTL: time.Minute, Algorithm: algorithm}
+
+		s.Take(ctx, key, limit, 2)
+		if err := s.Refund(ctx, key, limit, 1); err != nil {
+			t.Fatalf("%v refund should not fail. Error: %v", algorithm, err)
+		}
+		if state, _ := s.Peek(ctx, key, limit); !state.Allowed || state.Remaining != 1 {
+			t.Errorf("%v refund should give back one request. State: %+v", algorithm, state)
+		}
+	}
+}
+
+func TestMemoryAlgorithmChange(t *testing.T) {
+	s, _ := newTestMemory()
+	ctx := context.Background()
+	key := "TestMemoryAlgorithmChange"
+
+	s.Take(ctx, key, Limit{Max: 1, TTL: time.Second}, 1)
+
+	limit := Limit{Max: 1, TTL: time.Second, Algorithm: SlidingWindowLog}
+	if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+		t.Error("A bucket used with another algorithm should start over.")
+	}
+	if state, _ := s.Take(ctx, key, limit, 1); state.Allowed {
+		t.Error("The sliding log should be kept once created.")
+	}
+}
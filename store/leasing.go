@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultLeasingConfig is the leasing used by NewLeasing.
+var DefaultLeasingConfig = LeasingConfig{
+	BatchSize: 10,
+	LeaseTTL:  time.Second,
+}
+
+// LeasingConfig sets how many tokens a Leasing store leases from its remote store, and for how long.
+type LeasingConfig struct {
+	// Number of tokens leased from the remote store at once, and bound of the approximation:
+	// every instance holds at most BatchSize-1 unused tokens of a key. Those tokens are counted as
+	// taken by the remote store, other instances may be denied while they are unused, and they may
+	// be used in the next window of window algorithms, admitting up to BatchSize-1 extra requests per
+	// instance in a window. One means no leasing.
+	BatchSize int64
+
+	// Duration after which unused leased tokens are given back to the remote store, or dropped when
+	// it can't refund them. It bounds how long after being leased a token is used.
+	LeaseTTL time.Duration
+}
+
+// Leasing is a Store serving tokens leased by batches from a remote store, typically redis,
+// to save a round trip to the remote store on most requests.
+type Leasing struct {
+	remote Store
+	conf   LeasingConfig
+	now    func() time.Time
+
+	leases map[string]*lease
+	sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// lease holds the tokens of a key leased from the remote store and not used yet.
+type lease struct {
+	limit   Limit
+	tokens  int64
+	expires time.Time
+
+	// State of the remote bucket when the tokens were leased.
+	state State
+
+	// Whether the lease was removed from the store, it must then be looked up again.
+	dropped bool
+
+	sync.Mutex
+}
+
+// NewLeasing is a constructor for Leasing using DefaultLeasingConfig.
+func NewLeasing(remote Store) *Leasing {
+	return NewLeasingWithConfig(remote, DefaultLeasingConfig)
+}
+
+// NewLeasingWithConfig is a constructor for Leasing.
+// Close must be called to give back the unused tokens and stop the janitor returning expired leases.
+func NewLeasingWithConfig(remote Store, conf LeasingConfig) *Leasing {
+	if conf.BatchSize < 1 {
+		conf.BatchSize = 1
+	}
+	if conf.LeaseTTL <= 0 {
+		conf.LeaseTTL = DefaultLeasingConfig.LeaseTTL
+	}
+
+	s := &Leasing{
+		remote: remote,
+		conf:   conf,
+		now:    time.Now,
+		leases: make(map[string]*lease),
+		stop:   make(chan struct{}),
+	}
+	go s.janitor(conf.LeaseTTL)
+
+	return s
+}
+
+// Remote returns the store the tokens are leased from.
+func (s *Leasing) Remote() Store {
+	return s.remote
+}
+
+// Take removes n tokens from the tokens of key leased by this instance, leasing a new batch
+// from the remote store when they are not enough.
+func (s *Leasing) Take(ctx context.Context, key string, limit Limit, n int64) (State, error) {
+	if limit.TTL <= 0 {
+		return s.remote.Take(ctx, key, limit, n)
+	}
+
+	l := s.lock(ctx, key, limit)
+	defer l.Unlock()
+
+	if l.tokens >= n {
+		l.tokens -= n
+		return l.localState(), nil
+	}
+
+	// The tokens left are kept, only the missing ones are leased.
+	need := n - l.tokens
+	batch := s.conf.BatchSize
+	if batch > limit.Max {
+		batch = limit.Max
+	}
+	if batch < need {
+		batch = need
+	}
+
+	state, err := s.remote.Take(ctx, key, limit, batch)
+	if err == nil && !state.Allowed && batch > need {
+		// Not enough tokens left for a batch, take exactly the missing ones.
+		batch = need
+		state, err = s.remote.Take(ctx, key, limit, batch)
+	}
+	if err != nil {
+		return State{}, err
+	}
+	if !state.Allowed {
+		state.Remaining += l.tokens
+		return state, nil
+	}
+
+	l.tokens += batch - n
+	l.state = state
+	l.expires = s.now().Add(s.conf.LeaseTTL)
+	return l.localState(), nil
+}
+
+// Peek reports the state of the remote bucket identified by key, counting the tokens leased by this instance.
+func (s *Leasing) Peek(ctx context.Context, key string, limit Limit) (State, error) {
+	state, err := s.remote.Peek(ctx, key, limit)
+	if err != nil || limit.TTL <= 0 {
+		return state, err
+	}
+
+	l := s.lock(ctx, key, limit)
+	defer l.Unlock()
+
+	if l.tokens > 0 {
+		state.Allowed = true
+		state.Remaining += l.tokens
+		state.RetryAfter = 0
+	}
+	return state, nil
+}
+
+// Refund gives back n tokens to the tokens of key leased by this instance.
+func (s *Leasing) Refund(ctx context.Context, key string, limit Limit, n int64) error {
+	if limit.TTL <= 0 {
+		return nil
+	}
+
+	l := s.lock(ctx, key, limit)
+	defer l.Unlock()
+
+	l.tokens += n
+	if l.expires.IsZero() {
+		l.expires = s.now().Add(s.conf.LeaseTTL)
+	}
+	return nil
+}
+
+// Reset drops the tokens of key leased by this instance and refills the remote bucket.
+func (s *Leasing) Reset(ctx context.Context, key string) error {
+	s.Lock()
+	if l, found := s.leases[key]; found {
+		l.Lock()
+		l.tokens, l.dropped = 0, true
+		l.Unlock()
+		delete(s.leases, key)
+	}
+	s.Unlock()
+
+	return s.remote.Reset(ctx, key)
+}
+
+// Close gives back every unused token to the remote store, stops the janitor and closes the remote store.
+// The store remains usable.
+func (s *Leasing) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.returnExpired(time.Time{})
+
+	if closer, ok := s.remote.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// lock returns the locked lease of key, after giving back its tokens when it expired or when
+// they were leased for another limit.
+func (s *Leasing) lock(ctx context.Context, key string, limit Limit) *lease {
+	for {
+		s.Lock()
+		l, found := s.leases[key]
+		if !found {
+			l = &lease{limit: limit}
+			s.leases[key] = l
+		}
+		s.Unlock()
+
+		l.Lock()
+		if l.dropped {
+			l.Unlock()
+			continue
+		}
+
+		// The TTL is not compared, it changes on every call for quotas.
+		if l.limit.Max != limit.Max || l.limit.algorithm() != limit.algorithm() || (l.tokens > 0 && !s.now().Before(l.expires)) {
+			s.giveBack(ctx, key, l)
+		}
+		l.limit = limit
+		return l
+	}
+}
+
+// giveBack refunds the unused tokens of the locked lease l of key to the remote store when it supports it.
+func (s *Leasing) giveBack(ctx context.Context, key string, l *lease) {
+	if l.tokens > 0 {
+		if refunder, ok := s.remote.(Refunder); ok {
+			refunder.Refund(ctx, key, l.limit, l.tokens)
+		}
+	}
+	l.tokens, l.expires, l.state = 0, time.Time{}, State{}
+}
+
+// returnExpired gives back the tokens of every lease expired at now, every lease when now is zero,
+// and drops those leases.
+func (s *Leasing) returnExpired(now time.Time) {
+	s.Lock()
+	expired := make(map[string]*lease)
+	for key, l := range s.leases {
+		// Leases in use, possibly waiting for the remote store, are returned on the next sweep.
+		if now.IsZero() {
+			l.Lock()
+		} else if !l.TryLock() {
+			continue
+		}
+		if now.IsZero() || !now.Before(l.expires) {
+			l.dropped = true
+			delete(s.leases, key)
+			expired[key] = l
+		}
+		l.Unlock()
+	}
+	s.Unlock()
+
+	for key, l := range expired {
+		l.Lock()
+		s.giveBack(context.Background(), key, l)
+		l.Unlock()
+	}
+}
+
+func (s *Leasing) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.returnExpired(s.now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// localState returns the state of the bucket when a request is served from the leased tokens.
+func (l *lease) localState() State {
+	return State{
+		Allowed:   true,
+		Remaining: l.state.Remaining + l.tokens,
+		ResetAt:   l.state.ResetAt,
+	}
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingRemote counts the takes reaching a remote store.
+type countingRemote struct {
+	*Memory
+	takes int
+	sync.Mutex
+}
+
+func (s *countingRemote) Take(ctx context.Context, key string, limit Limit, n int64) (State, error) {
+	s.Lock()
+	s.takes++
+	s.Unlock()
+	return s.Memory.Take(ctx, key, limit, n)
+}
+
+func TestLeasingTake(t *testing.T) {
+	remote := &countingRemote{Memory: NewMemory()}
+	s := NewLeasingWithConfig(remote, LeasingConfig{BatchSize: 10, LeaseTTL: time.Minute})
+	defer s.Close()
+	ctx := context.Background()
+	limit := Limit{Max: 100, TTL: time.Minute, Algorithm: FixedWindow}
+
+	state, err := s.Take(ctx, "TestLeasingTake", limit, 1)
+	if err != nil || !state.Allowed || state.Remaining != 99 {
+		t.Errorf("First take should lease a batch. State: %+v, Error: %v", state, err)
+	}
+	for i := 0; i < 24; i++ {
+		s.Take(ctx, "TestLeasingTake", limit, 1)
+	}
+	if remote.takes != 3 {
+		t.Errorf("25 takes should reach the remote store 3 times. Takes: %v", remote.takes)
+	}
+	if state, _ := s.Peek(ctx, "TestLeasingTake", limit); state.Remaining != 75 {
+		t.Errorf("Peek should count the leased tokens as remaining. State: %+v", state)
+	}
+}
+
+func TestLeasingExhaustion(t *testing.T) {
+	s := NewLeasingWithConfig(NewMemory(), LeasingConfig{BatchSize: 10, LeaseTTL: time.Minute})
+	defer s.Close()
+	ctx := context.Background()
+	limit := Limit{Max: 15, TTL: time.Minute, Algorithm: FixedWindow}
+
+	for i := 0; i < 15; i++ {
+		if state, _ := s.Take(ctx, "TestLeasingExhaustion", limit, 1); !state.Allowed {
+			t.Errorf("Take %d should be allowed with the tokens left by the last batch. State: %+v", i, state)
+		}
+	}
+	if state, _ := s.Take(ctx, "TestLeasingExhaustion", limit, 1); state.Allowed || state.RetryAfter <= 0 {
+		t.Errorf("Take should be denied once the remote bucket is empty. State: %+v", state)
+	}
+}
+
+func TestLeasingExpiry(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	remote := NewMemory()
+	remote.now = clock
+	s := NewLeasingWithConfig(remote, LeasingConfig{BatchSize: 10, LeaseTTL: time.Second})
+	s.now = clock
+	ctx := context.Background()
+	limit := Limit{Max: 100, TTL: time.Minute, Algorithm: FixedWindow}
+
+	s.Take(ctx, "TestLeasingExpiry", limit, 1)
+	if state, _ := remote.Peek(ctx, "TestLeasingExpiry", limit); state.Remaining != 90 {
+		t.Errorf("Remote store should count the leased batch. State: %+v", state)
+	}
+
+	now = now.Add(time.Second)
+	s.returnExpired(now)
+	if state, _ := remote.Peek(ctx, "TestLeasingExpiry", limit); state.Remaining != 99 {
+		t.Errorf("Unused tokens should be given back once the lease expired. State: %+v", state)
+	}
+
+	s.Take(ctx, "TestLeasingExpiry", limit, 1)
+	s.Close()
+	if state, _ := remote.Peek(ctx, "TestLeasingExpiry", limit); state.Remaining != 98 {
+		t.Errorf("Unused tokens should be given back on Close. State: %+v", state)
+	}
+}
+
+func TestLeasingRefundAndReset(t *testing.T) {
+	remote := &countingRemote{Memory: NewMemory()}
+	s := NewLeasingWithConfig(remote, LeasingConfig{BatchSize: 10, LeaseTTL: time.Minute})
+	defer s.Close()
+	ctx := context.Background()
+	limit := Limit{Max: 10, TTL: time.Minute}
+
+	s.Take(ctx, "TestLeasingRefundAndReset", limit, 10)
+	s.Refund(ctx, "TestLeasingRefundAndReset", limit, 2)
+	if state, _ := s.Take(ctx, "TestLeasingRefundAndReset", limit, 2); !state.Allowed || remote.takes != 1 {
+		t.Errorf("Refunded tokens should be served locally. State: %+v, Takes: %v", state, remote.takes)
+	}
+
+	s.Reset(ctx, "TestLeasingRefundAndReset")
+	if state, _ := s.Take(ctx, "TestLeasingRefundAndReset", limit, 10); !state.Allowed {
+		t.Errorf("Bucket should be refilled by Reset. State: %+v", state)
+	}
+}
+
+// TestLeasingErrorBound documents the approximation of leasing: in a window, the instances sharing
+// a remote store admit at most Max + instances*(BatchSize-1) requests of a key, the worst case being
+// tokens leased at the end of a window and used in the next one.
+func TestLeasingErrorBound(t *testing.T) {
+	const instances = 3
+	limit := Limit{Max: 20, TTL: time.Second, Algorithm: SlidingWindowLog}
+
+	for _, batchSize := range []int64{1, 5} {
+		now := time.Now()
+		clock := func() time.Time { return now }
+		remote := NewMemory()
+		remote.now = clock
+
+		stores := make([]*Leasing, instances)
+		for i := range stores {
+			stores[i] = NewLeasingWithConfig(remote, LeasingConfig{BatchSize: batchSize, LeaseTTL: 2 * limit.TTL})
+			stores[i].now = clock
+		}
+		ctx := context.Background()
+
+		// Every instance leases a batch for a single request at the end of a window.
+		for _, s := range stores {
+			s.Take(ctx, "TestLeasingErrorBound", limit, 1)
+		}
+
+		// Every request of the next window is admitted while tokens are left.
+		now = now.Add(limit.TTL + time.Millisecond)
+		var admitted int64
+		for _, s := range stores {
+			for {
+				state, _ := s.Take(ctx, "TestLeasingErrorBound", limit, 1)
+				if !state.Allowed {
+					break
+				}
+				admitted++
+			}
+		}
+
+		bound := limit.Max + instances*(batchSize-1)
+		if admitted > bound {
+			t.Errorf("Instances leasing %d tokens should admit at most %d requests in a window. Admitted: %v", batchSize, bound, admitted)
+		}
+		if batchSize == 1 && admitted != limit.Max {
+			t.Errorf("Instances leasing single tokens should be exact. Admitted: %v", admitted)
+		}
+
+		for _, s := range stores {
+			s.Close()
+		}
+	}
+}
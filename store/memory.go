@@ -0,0 +1,356 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMemoryConfig is the eviction used by NewMemory.
+var DefaultMemoryConfig = MemoryConfig{
+	MaxKeys:         100000,
+	CleanupInterval: time.Minute,
+	Shards:          32,
+}
+
+// MemoryConfig sets how a Memory store evicts its buckets.
+type MemoryConfig struct {
+	// Maximum number of buckets to keep, the least recently used one is evicted beyond.
+	// The limit is split evenly between shards. Zero means no limit.
+	MaxKeys int
+
+	// Duration after which an unused bucket expires, once it is also refilled so that dropping it
+	// can't change any decision. Zero expires a bucket as soon as it is refilled.
+	IdleTTL time.Duration
+
+	// Interval between two sweeps of expired buckets.
+	// Zero disables the janitor, expired buckets are then only dropped by MaxKeys.
+	CleanupInterval time.Duration
+
+	// Number of independently locked partitions of the buckets.
+	// Zero means a single partition.
+	Shards int
+}
+
+// MemoryStats counts the buckets of a Memory store.
+type MemoryStats struct {
+	// Number of buckets currently kept.
+	Keys int
+
+	// Number of buckets dropped because MaxKeys was reached.
+	Evicted uint64
+
+	// Number of buckets dropped because they expired.
+	Expired uint64
+}
+
+// Memory is a Store that keeps rate-limit buckets in the memory of the process.
+// It suits single-instance deployments, the buckets are not shared between processes.
+type Memory struct {
+	conf   MemoryConfig
+	shards []*shard
+	now    func() time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// shard holds the buckets whose key hashes to it, with their own lock.
+type shard struct {
+	buckets map[string]*list.Element
+	lru     *list.List
+	stats   MemoryStats
+	maxKeys int
+
+	sync.Mutex
+}
+
+// bucket is the state of a key for the algorithm it was last used with.
+type bucket struct {
+	key       string
+	algorithm Algorithm
+	state     bucketState
+	expires   time.Time
+}
+
+// NewMemory is a constructor for Memory using DefaultMemoryConfig.
+func NewMemory() *Memory {
+	return NewMemoryWithConfig(DefaultMemoryConfig)
+}
+
+// NewMemoryWithConfig is a constructor for Memory.
+// Close must be called to stop the janitor when conf.CleanupInterval is set.
+func NewMemoryWithConfig(conf MemoryConfig) *Memory {
+	s := &Memory{
+		conf:   conf,
+		shards: make([]*shard, 1),
+		now:    time.Now,
+		stop:   make(chan struct{}),
+	}
+	if conf.Shards > 1 {
+		s.shards = make([]*shard, conf.Shards)
+	}
+
+	maxKeys := conf.MaxKeys
+	if maxKeys > 0 {
+		maxKeys = (maxKeys + len(s.shards) - 1) / len(s.shards)
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			buckets: make(map[string]*list.Element),
+			lru:     list.New(),
+			maxKeys: maxKeys,
+		}
+	}
+
+	if conf.CleanupInterval > 0 {
+		go s.janitor(conf.CleanupInterval)
+	}
+
+	return s
+}
+
+// Take removes n tokens from the bucket identified by key when they are available.
+func (s *Memory) Take(ctx context.Context, key string, limit Limit, n int64) (State, error) {
+	now := s.now()
+	if limit.TTL <= 0 {
+		return unlimitedState(limit, now), nil
+	}
+
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	b := sh.touch(key, limit, now)
+	state := b.state.take(limit, n, now)
+	b.expires = s.expiry(b, limit, now)
+
+	return state, nil
+}
+
+// TakeAll removes n tokens from every bucket of keys, limited by the limit of the same index, when all
+// of them are available. The shards of the buckets stay locked meanwhile, so that tokens given back
+// when a bucket denies the request are never seen by other requests.
+func (s *Memory) TakeAll(ctx context.Context, keys []string, limits []Limit, n int64) ([]State, error) {
+	now := s.now()
+	shards := s.lockShards(keys)
+	defer func() {
+		for _, sh := range shards {
+			sh.Unlock()
+		}
+	}()
+
+	states := make([]State, len(keys))
+	allowed := true
+	for i, key := range keys {
+		if limits[i].TTL <= 0 {
+			states[i] = unlimitedState(limits[i], now)
+			continue
+		}
+		b := s.shard(key).touch(key, limits[i], now)
+		states[i] = b.state.take(limits[i], n, now)
+		b.expires = s.expiry(b, limits[i], now)
+		allowed = allowed && states[i].Allowed
+	}
+	if allowed {
+		return states, nil
+	}
+
+	for i, key := range keys {
+		if limits[i].TTL <= 0 || !states[i].Allowed {
+			continue
+		}
+		if element, found := s.shard(key).buckets[key]; found {
+			b := element.Value.(*bucket)
+			b.state.refund(limits[i], n, now)
+			b.expires = s.expiry(b, limits[i], now)
+		}
+	}
+	return states, nil
+}
+
+// Peek reports the state of the bucket identified by key without taking any token.
+func (s *Memory) Peek(ctx context.Context, key string, limit Limit) (State, error) {
+	now := s.now()
+	if limit.TTL <= 0 {
+		return unlimitedState(limit, now), nil
+	}
+
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if element, found := sh.buckets[key]; found {
+		if b := element.Value.(*bucket); b.current(limit, now) {
+			return b.state.peek(limit, now), nil
+		}
+	}
+
+	return newBucketState(limit, now).peek(limit, now), nil
+}
+
+// Refund gives back n tokens taken from the bucket identified by key.
+func (s *Memory) Refund(ctx context.Context, key string, limit Limit, n int64) error {
+	now := s.now()
+	if limit.TTL <= 0 {
+		return nil
+	}
+
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if element, found := sh.buckets[key]; found {
+		if b := element.Value.(*bucket); b.current(limit, now) {
+			b.state.refund(limit, n, now)
+			b.expires = s.expiry(b, limit, now)
+		}
+	}
+	return nil
+}
+
+// Reset refills the bucket identified by key.
+func (s *Memory) Reset(ctx context.Context, key string) error {
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if element, found := sh.buckets[key]; found {
+		sh.remove(element)
+	}
+	return nil
+}
+
+// Stats returns the bucket counters of the store.
+func (s *Memory) Stats() MemoryStats {
+	var stats MemoryStats
+	for _, sh := range s.shards {
+		sh.Lock()
+		stats.Keys += len(sh.buckets)
+		stats.Evicted += sh.stats.Evicted
+		stats.Expired += sh.stats.Expired
+		sh.Unlock()
+	}
+	return stats
+}
+
+// Close stops the janitor. The store remains usable.
+func (s *Memory) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	return nil
+}
+
+// shard returns the partition of key.
+func (s *Memory) shard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// shardIndex returns the index of the partition of key using the FNV-1a hash.
+func (s *Memory) shardIndex(key string) int {
+	if len(s.shards) == 1 {
+		return 0
+	}
+
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(s.shards)))
+}
+
+// lockShards locks the partitions of keys once each, in index order so that concurrent calls
+// can't deadlock, and returns them.
+func (s *Memory) lockShards(keys []string) []*shard {
+	locked := make([]bool, len(s.shards))
+	for _, key := range keys {
+		locked[s.shardIndex(key)] = true
+	}
+
+	var shards []*shard
+	for i, sh := range s.shards {
+		if locked[i] {
+			sh.Lock()
+			shards = append(shards, sh)
+		}
+	}
+	return shards
+}
+
+// expiry returns when the bucket can be dropped: once it is refilled and, with IdleTTL, unused for IdleTTL.
+// Buckets refilled after a longer time, such as quotas, are kept until then.
+func (s *Memory) expiry(b *bucket, limit Limit, now time.Time) time.Time {
+	expiry := b.state.expiry(limit)
+	if idle := now.Add(s.conf.IdleTTL); s.conf.IdleTTL > 0 && idle.After(expiry) {
+		return idle
+	}
+	return expiry
+}
+
+// deleteExpired drops every bucket expired at now, one shard at a time.
+func (s *Memory) deleteExpired() {
+	for _, sh := range s.shards {
+		sh.deleteExpired(s.now())
+	}
+}
+
+func (s *Memory) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.deleteExpired()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// touch returns the bucket identified by key, created when missing, and marks it as recently used.
+func (sh *shard) touch(key string, limit Limit, now time.Time) *bucket {
+	if element, found := sh.buckets[key]; found {
+		b := element.Value.(*bucket)
+		if !b.current(limit, now) {
+			b.algorithm = limit.algorithm()
+			b.state = newBucketState(limit, now)
+		}
+		sh.lru.MoveToFront(element)
+		return b
+	}
+
+	if sh.maxKeys > 0 && len(sh.buckets) >= sh.maxKeys {
+		sh.remove(sh.lru.Back())
+		sh.stats.Evicted++
+	}
+
+	b := &bucket{key: key, algorithm: limit.algorithm(), state: newBucketState(limit, now)}
+	sh.buckets[key] = sh.lru.PushFront(b)
+	return b
+}
+
+func (sh *shard) remove(element *list.Element) {
+	sh.lru.Remove(element)
+	delete(sh.buckets, element.Value.(*bucket).key)
+}
+
+func (sh *shard) deleteExpired(now time.Time) {
+	sh.Lock()
+	defer sh.Unlock()
+
+	for _, element := range sh.buckets {
+		if !element.Value.(*bucket).expires.After(now) {
+			sh.remove(element)
+			sh.stats.Expired++
+		}
+	}
+}
+
+// current reports whether the state of the bucket applies to limit at now.
+// An expired bucket behaves like a new one even if the janitor has not dropped it yet,
+// and so does a bucket last used with another algorithm.
+func (b *bucket) current(limit Limit, now time.Time) bool {
+	return b.expires.After(now) && b.algorithm == limit.algorithm()
+}
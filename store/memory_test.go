@@ -0,0 +1,243 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestMemory returns a Memory store whose clock only moves when the returned function is called.
+func newTestMemory() (*Memory, func(time.Duration)) {
+	now := time.Unix(1500000000, 0)
+	s := NewMemoryWithConfig(MemoryConfig{})
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestMemoryTake(t *testing.T) {
+	s, _ := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 3, TTL: time.Second}
+
+	for i := 0; i < 3; i++ {
+		state, _ := s.Take(ctx, "TestMemoryTake", limit, 1)
+		if !state.Allowed {
+			t.Errorf("N(%v) take should be allowed.", i)
+		}
+		if state.Remaining != int64(2-i) {
+			t.Errorf("N(%v) take left the wrong number of tokens. Remaining: %v", i, state.Remaining)
+		}
+	}
+
+	state, _ := s.Take(ctx, "TestMemoryTake", limit, 1)
+	if state.Allowed {
+		t.Error("Fourth take should not be allowed because the bucket is empty.")
+	}
+
+	state, _ = s.Take(ctx, "TestMemoryTakeOtherKey", limit, 1)
+	if !state.Allowed {
+		t.Error("Buckets of other keys should not be affected.")
+	}
+}
+
+func TestMemoryRefill(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 2, TTL: 100 * time.Millisecond}
+	key := "TestMemoryRefill"
+
+	s.Take(ctx, key, limit, 2)
+
+	advance(50 * time.Millisecond)
+	if state, _ := s.Take(ctx, key, limit, 1); state.Allowed {
+		t.Error("Half a TTL should not refill a whole token.")
+	}
+
+	advance(50 * time.Millisecond)
+	if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+		t.Error("One TTL should refill one token.")
+	}
+
+	advance(time.Hour)
+	if state, _ := s.Peek(ctx, key, limit); state.Remaining != 2 {
+		t.Errorf("Refill should be capped by Max. Remaining: %v", state.Remaining)
+	}
+}
+
+func TestMemoryTakeN(t *testing.T) {
+	s, _ := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 5, TTL: time.Second}
+	key := "TestMemoryTakeN"
+
+	if state, _ := s.Take(ctx, key, limit, 4); !state.Allowed || state.Remaining != 1 {
+		t.Errorf("Taking 4 out of 5 tokens should be allowed. State: %+v", state)
+	}
+	if state, _ := s.Take(ctx, key, limit, 2); state.Allowed || state.Remaining != 1 {
+		t.Errorf("Taking 2 out of 1 token should not be allowed nor consume it. State: %+v", state)
+	}
+}
+
+func TestMemoryPeekAndReset(t *testing.T) {
+	s, _ := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 1, TTL: time.Second}
+	key := "TestMemoryPeekAndReset"
+
+	if state, _ := s.Peek(ctx, key, limit); !state.Allowed || state.Remaining != 1 {
+		t.Errorf("Peek should report a full bucket for an unknown key. State: %+v", state)
+	}
+
+	s.Take(ctx, key, limit, 1)
+	if state, _ := s.Peek(ctx, key, limit); state.Allowed || state.Remaining != 0 {
+		t.Errorf("Peek should report an empty bucket. State: %+v", state)
+	}
+	if state, _ := s.Peek(ctx, key, limit); state.Remaining != 0 {
+		t.Errorf("Peek should not take tokens. State: %+v", state)
+	}
+
+	s.Reset(ctx, key)
+	if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+		t.Error("Take should be allowed after Reset.")
+	}
+}
+
+func TestMemoryMaxKeys(t *testing.T) {
+	s := NewMemoryWithConfig(MemoryConfig{MaxKeys: 2})
+	ctx := context.Background()
+	limit := Limit{Max: 1, TTL: time.Hour}
+
+	s.Take(ctx, "a", limit, 1)
+	s.Take(ctx, "b", limit, 1)
+	s.Take(ctx, "a", limit, 1)
+	s.Take(ctx, "c", limit, 1)
+
+	stats := s.Stats()
+	if stats.Keys != 2 || stats.Evicted != 1 {
+		t.Errorf("One bucket should have been evicted to keep 2 keys. Stats: %+v", stats)
+	}
+	if state, _ := s.Peek(ctx, "a", limit); state.Allowed {
+		t.Error("Recently used bucket a should have been kept.")
+	}
+	if state, _ := s.Peek(ctx, "b", limit); !state.Allowed {
+		t.Error("Least recently used bucket b should have been evicted.")
+	}
+}
+
+func TestMemoryExpiresRefilledBuckets(t *testing.T) {
+	s, advance := newTestMemory()
+	ctx := context.Background()
+	limit := Limit{Max: 2, TTL: time.Second}
+
+	s.Take(ctx, "full", limit, 0)
+	s.Take(ctx, "empty", limit, 2)
+
+	s.deleteExpired()
+	if stats := s.Stats(); stats.Keys != 1 || stats.Expired != 1 {
+		t.Errorf("Only the full bucket should have expired. Stats: %+v", stats)
+	}
+
+	advance(2 * time.Second)
+	s.deleteExpired()
+	if stats := s.Stats(); stats.Keys != 0 || stats.Expired != 2 {
+		t.Errorf("The refilled bucket should have expired. Stats: %+v", stats)
+	}
+}
+
+func TestMemoryIdleTTL(t *testing.T) {
+	s, advance := newTestMemory()
+	s.conf.IdleTTL = time.Minute
+	ctx := context.Background()
+	limit := Limit{Max: 1, TTL: time.Hour}
+	key := "TestMemoryIdleTTL"
+
+	s.Take(ctx, key, limit, 1)
+	advance(30 * time.Second)
+	if state, _ := s.Take(ctx, key, limit, 1); state.Allowed {
+		t.Error("Bucket used within IdleTTL should be kept.")
+	}
+
+	advance(time.Minute)
+	s.deleteExpired()
+	if state, _ := s.Peek(ctx, key, limit); state.Allowed {
+		t.Error("Bucket idle for IdleTTL should be kept until it is refilled.")
+	}
+
+	advance(time.Hour)
+	if state, _ := s.Peek(ctx, key, limit); !state.Allowed {
+		t.Error("Bucket refilled and idle for IdleTTL should behave like a new one.")
+	}
+	s.deleteExpired()
+	if stats := s.Stats(); stats.Keys != 0 || stats.Expired != 1 {
+		t.Errorf("Idle bucket should have been dropped. Stats: %+v", stats)
+	}
+}
+
+func TestMemoryJanitor(t *testing.T) {
+	s := NewMemoryWithConfig(MemoryConfig{CleanupInterval: 10 * time.Millisecond})
+	defer s.Close()
+
+	s.Take(context.Background(), "TestMemoryJanitor", Limit{Max: 1, TTL: time.Millisecond}, 1)
+
+	<-time.After(50 * time.Millisecond)
+	if stats := s.Stats(); stats.Keys != 0 {
+		t.Errorf("Janitor should have dropped the refilled bucket. Stats: %+v", stats)
+	}
+}
+
+func TestMemoryShards(t *testing.T) {
+	s := NewMemoryWithConfig(MemoryConfig{Shards: 8, MaxKeys: 80})
+	ctx := context.Background()
+	limit := Limit{Max: 1, TTL: time.Hour}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("127.0.0.%v|/", i)
+		if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+			t.Errorf("First take of %v should be allowed.", key)
+		}
+		if state, _ := s.Take(ctx, key, limit, 1); state.Allowed {
+			t.Errorf("Second take of %v should not be allowed.", key)
+		}
+	}
+
+	stats := s.Stats()
+	if stats.Keys > 80 || stats.Keys+int(stats.Evicted) != 1000 {
+		t.Errorf("Each shard should keep at most MaxKeys/Shards buckets. Stats: %+v", stats)
+	}
+}
+
+// testTakeAll checks that TakeAll of s takes from no bucket when one of them is empty.
+func testTakeAll(t *testing.T, s interface {
+	Store
+	MultiTaker
+}, prefix string) {
+	ctx := context.Background()
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingWindowLog, SlidingWindowCounter, GCRA, FixedWindow} {
+		keys := []string{prefix + algorithm.String() + ".second", prefix + algorithm.String() + ".hour"}
+		limits := []Limit{{Max: 3, TTL: time.Minute, Algorithm: algorithm}, {Max: 1, TTL: time.Hour, Algorithm: algorithm}}
+		for _, key := range keys {
+			s.Reset(ctx, key)
+		}
+
+		states, err := s.TakeAll(ctx, keys, limits, 1)
+		if err != nil || len(states) != 2 || !states[0].Allowed || !states[1].Allowed || states[0].Remaining != 2 {
+			t.Fatalf("%v first take should be allowed by both buckets. States: %+v, Error: %v", algorithm, states, err)
+		}
+		states, _ = s.TakeAll(ctx, keys, limits, 1)
+		if !states[0].Allowed || states[1].Allowed {
+			t.Errorf("%v second take should be denied by the second bucket only. States: %+v", algorithm, states)
+		}
+		if state, _ := s.Peek(ctx, keys[0], limits[0]); state.Remaining != 2 {
+			t.Errorf("%v denied take should not be counted by the first bucket. State: %+v", algorithm, state)
+		}
+	}
+}
+
+func TestMemoryTakeAll(t *testing.T) {
+	s, _ := newTestMemory()
+	testTakeAll(t, s, "TestMemoryTakeAll")
+
+	sharded := NewMemoryWithConfig(MemoryConfig{Shards: 8})
+	testTakeAll(t, sharded, "TestMemoryTakeAll")
+}
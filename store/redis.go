@@ -0,0 +1,717 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	rate "github.com/aw16com/rate/redis"
+	redis "github.com/go-redis/redis"
+)
+
+// takeSource is the token bucket of github.com/aw16com/rate/redis, so both share the keys they write.
+// Like it, the bucket is refilled on whole seconds: requests within the same second see no refill.
+const takeSource = `
+local tokens_key = KEYS[1]
+local timestamp_key = KEYS[2]
+
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+local write = ARGV[5] ~= "0"
+
+local fill_time = capacity/rate
+local ttl = math.max(1, math.ceil(fill_time*2))
+
+local last_tokens = tonumber(redis.call("get", tokens_key))
+if last_tokens == nil then
+    last_tokens = capacity
+end
+
+local last_refreshed = tonumber(redis.call("get", timestamp_key))
+if last_refreshed == nil then
+    last_refreshed = 0
+end
+
+local delta = math.max(0, now-last_refreshed)
+local filled_tokens = math.min(capacity, last_tokens+(delta*rate))
+local allowed = filled_tokens >= requested
+local new_tokens = filled_tokens
+if allowed then
+    new_tokens = filled_tokens - requested
+end
+
+if write then
+    redis.call("setex", tokens_key, ttl, new_tokens)
+    redis.call("setex", timestamp_key, ttl, now)
+end
+
+return { allowed, tostring(new_tokens) }
+`
+
+// peekScript computes the tokens of a bucket like takeSource without writing them back.
+var peekScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local last_tokens = tonumber(redis.call("get", KEYS[1]))
+if last_tokens == nil then
+    return tostring(capacity)
+end
+
+local last_refreshed = tonumber(redis.call("get", KEYS[2]))
+if last_refreshed == nil then
+    last_refreshed = 0
+end
+
+return tostring(math.min(capacity, last_tokens+(math.max(0, now-last_refreshed)*rate)))
+`)
+
+// slidingLogSource keeps the times of the allowed requests, in microseconds, in a sorted set.
+// Members are made unique with a sequence so that requests at the same time are all kept.
+const slidingLogSource = `
+local log_key = KEYS[1]
+local seq_key = KEYS[2]
+
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+local write = ARGV[5] == "1"
+
+local pruned = redis.call("zcount", log_key, "-inf", now-window)
+if write then
+    redis.call("zremrangebyscore", log_key, "-inf", now-window)
+    pruned = 0
+end
+
+local count = redis.call("zcard", log_key) - pruned
+local allowed = count+requested <= capacity
+if allowed and write then
+    local seq = redis.call("incrby", seq_key, requested)
+    for i = 1, requested do
+        redis.call("zadd", log_key, now, tostring(seq-requested+i))
+    end
+    local ttl = math.ceil(window/1000)
+    redis.call("pexpire", log_key, ttl)
+    redis.call("pexpire", seq_key, ttl)
+    count = count + requested
+end
+
+local released = ""
+local newest = ""
+if count > 0 then
+    newest = redis.call("zrange", log_key, -1, -1, "withscores")[2]
+    released = newest
+    local needed = count + requested - capacity
+    if needed > 0 and needed <= count then
+        released = redis.call("zrange", log_key, pruned+needed-1, pruned+needed-1, "withscores")[2]
+    end
+end
+
+return { allowed, count, released, newest }
+`
+
+// slidingCounterSource counts the requests of the current and previous windows, aligned on the Unix epoch, in a hash.
+const slidingCounterSource = `
+local counter_key = KEYS[1]
+
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+local write = ARGV[5] == "1"
+
+local start = now - (now % window)
+local counter = redis.call("hmget", counter_key, "window", "prev", "curr")
+local current = tonumber(counter[1]) or start
+local prev = tonumber(counter[2]) or 0
+local curr = tonumber(counter[3]) or 0
+
+if start == current + window then
+    prev, curr, current = curr, 0, start
+elseif start > current then
+    prev, curr, current = 0, 0, start
+end
+
+local estimate = prev*(1-(now-current)/window) + curr
+local allowed = estimate+requested <= capacity
+if allowed and write then
+    curr = curr + requested
+end
+if write then
+    redis.call("hmset", counter_key, "window", current, "prev", prev, "curr", curr)
+    redis.call("pexpire", counter_key, math.ceil(window*2/1000))
+end
+
+return { allowed, prev, curr, current }
+`
+
+// gcraSource keeps the theoretical arrival time of the next request, in microseconds, in a single key.
+const gcraSource = `
+local tat_key = KEYS[1]
+
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local requested = tonumber(ARGV[4])
+local write = ARGV[5] == "1"
+
+local tat = math.max(tonumber(redis.call("get", tat_key)) or now, now)
+local allowed = tat + requested*interval <= now + burst
+if allowed and write then
+    tat = tat + requested*interval
+    redis.call("set", tat_key, tat, "px", math.max(1, math.ceil((tat-now)/1000)))
+end
+
+return { allowed, tat }
+`
+
+// fixedWindowSource counts the requests of a window in a key expiring at the end of the window.
+const fixedWindowSource = `
+local count_key = KEYS[1]
+
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local requested = tonumber(ARGV[3])
+local write = ARGV[4] == "1"
+
+local count = tonumber(redis.call("get", count_key)) or 0
+local ttl = redis.call("pttl", count_key)
+if ttl < 0 then
+    count = 0
+    ttl = window
+end
+
+local allowed = count+requested <= capacity
+if allowed and write then
+    count = redis.call("incrby", count_key, requested)
+    if count == requested then
+        redis.call("pexpire", count_key, ttl)
+    end
+end
+
+return { allowed, count, ttl }
+`
+
+// Scripts of the algorithms, run alone or together by takeAllScript.
+var (
+	takeScript           = redis.NewScript(takeSource)
+	slidingLogScript     = redis.NewScript(slidingLogSource)
+	slidingCounterScript = redis.NewScript(slidingCounterSource)
+	gcraScript           = redis.NewScript(gcraSource)
+	fixedWindowScript    = redis.NewScript(fixedWindowSource)
+)
+
+// takeAllScript runs the scripts of the algorithms of several buckets as functions of their keys and
+// arguments. Every bucket is first only read, and all of them are written only when all of them allow
+// the request. ARGV holds, for every bucket, the name of its algorithm, its numbers of keys and arguments,
+// then its arguments but the write flag. KEYS holds the keys of every bucket in order.
+var takeAllScript = redis.NewScript(`
+local algorithms = {
+    token_bucket = function(KEYS, ARGV)` + takeSource + `end,
+    sliding_window_log = function(KEYS, ARGV)` + slidingLogSource + `end,
+    sliding_window_counter = function(KEYS, ARGV)` + slidingCounterSource + `end,
+    gcra = function(KEYS, ARGV)` + gcraSource + `end,
+    fixed_window = function(KEYS, ARGV)` + fixedWindowSource + `end,
+}
+
+local function run(write)
+    local replies = {}
+    local allowed = true
+    local k, a = 1, 1
+    while a <= #ARGV do
+        local key_count, arg_count = tonumber(ARGV[a+1]), tonumber(ARGV[a+2])
+        local keys, args = {}, {}
+        for i = 1, key_count do
+            keys[i] = KEYS[k+i-1]
+        end
+        for i = 1, arg_count do
+            args[i] = ARGV[a+2+i]
+        end
+        args[arg_count+1] = write
+
+        local reply = algorithms[ARGV[a]](keys, args)
+        allowed = allowed and reply[1]
+        replies[#replies+1] = reply
+        k, a = k+key_count, a+3+arg_count
+    end
+    return allowed, replies
+end
+
+local allowed, replies = run("0")
+if allowed then
+    allowed, replies = run("1")
+end
+return replies
+`)
+
+// refundScript gives back tokens taken by the script of the algorithm passed first.
+// Buckets that expired in the meantime are left alone.
+var refundScript = redis.NewScript(`
+local key = KEYS[1]
+
+local algorithm = ARGV[1]
+local requested = tonumber(ARGV[2])
+local param = tonumber(ARGV[3])
+
+if algorithm == "sliding_window_log" then
+    redis.call("zpopmax", key, requested)
+    return 0
+end
+
+if algorithm == "sliding_window_counter" then
+    local curr = tonumber(redis.call("hget", key, "curr"))
+    if curr ~= nil then
+        redis.call("hset", key, "curr", math.max(0, curr-requested))
+    end
+    return 0
+end
+
+local value = tonumber(redis.call("get", key))
+local ttl = redis.call("pttl", key)
+if value == nil or ttl <= 0 then
+    return 0
+end
+
+if algorithm == "token_bucket" then
+    redis.call("psetex", key, ttl, math.min(param, value+requested))
+elseif algorithm == "gcra" then
+    ttl = math.ceil(ttl - requested*param/1000)
+    if ttl > 0 then
+        redis.call("psetex", key, ttl, value-requested*param)
+    else
+        redis.call("del", key)
+    end
+elseif algorithm == "fixed_window" then
+    if value > requested then
+        redis.call("decrby", key, requested)
+    else
+        redis.call("del", key)
+    end
+end
+
+return 0
+`)
+
+// Redis is a Store that keeps rate-limit buckets in redis, shared by every process using the same server.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis is a constructor for Redis.
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+// NewRedisFromConfig connects to the redis server described by conf.
+// The returned store is usable even with an error, it fails every call until redis is reachable.
+func NewRedisFromConfig(conf *rate.ConfigRedis) (*Redis, error) {
+	if conf == nil {
+		return NewRedis(nil), errors.New("redis config is empty")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", conf.Host, conf.Port),
+		Password: conf.Auth,
+		PoolSize: 200,
+	})
+	if _, err := client.Ping().Result(); err != nil {
+		return NewRedis(client), err
+	}
+
+	return NewRedis(client), nil
+}
+
+// Client returns the redis client of the store.
+func (s *Redis) Client() *redis.Client {
+	return s.client
+}
+
+// Take removes n tokens from the bucket identified by key when they are available.
+func (s *Redis) Take(ctx context.Context, key string, limit Limit, n int64) (State, error) {
+	return s.run(ctx, key, limit, n, true)
+}
+
+// Peek reports the state of the bucket identified by key without taking any token.
+func (s *Redis) Peek(ctx context.Context, key string, limit Limit) (State, error) {
+	return s.run(ctx, key, limit, 1, false)
+}
+
+// TakeAll removes n tokens from every bucket of keys, limited by the limit of the same index, when all
+// of them are available. The buckets are read and then written by a single script, so no other request
+// runs in between.
+func (s *Redis) TakeAll(ctx context.Context, keys []string, limits []Limit, n int64) ([]State, error) {
+	now := time.Now()
+	states := make([]State, len(keys))
+	calls := make([]scriptCall, 0, len(keys))
+	var scriptKeys []string
+	var args []interface{}
+	for i, key := range keys {
+		if limits[i].TTL <= 0 {
+			states[i] = unlimitedState(limits[i], now)
+			continue
+		}
+		call := algorithmCall(key, limits[i], n, now)
+		calls = append(calls, call)
+		scriptKeys = append(scriptKeys, call.keys...)
+		args = append(append(args, limits[i].algorithm().String(), len(call.keys), len(call.args)), call.args...)
+	}
+	if len(calls) == 0 {
+		return states, nil
+	}
+
+	client, err := s.clientWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []interface{}
+	err = withContext(ctx, func() (err error) {
+		replies, err = runScript(client, takeAllScript, scriptKeys, len(calls), args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	j := 0
+	for i := range keys {
+		if limits[i].TTL <= 0 {
+			continue
+		}
+		rs, ok := replies[j].([]interface{})
+		if !ok || len(rs) != calls[j].size {
+			return nil, fmt.Errorf("unexpected redis reply %v", replies[j])
+		}
+		if states[i], err = calls[j].parse(rs); err != nil {
+			return nil, err
+		}
+		j++
+	}
+	return states, nil
+}
+
+// run takes n tokens from the bucket identified by key with the script of the limit's algorithm,
+// or only reads the bucket when write is false.
+func (s *Redis) run(ctx context.Context, key string, limit Limit, n int64, write bool) (State, error) {
+	now := time.Now()
+	if limit.TTL <= 0 {
+		return unlimitedState(limit, now), nil
+	}
+
+	client, err := s.clientWithContext(ctx)
+	if err != nil {
+		return State{}, err
+	}
+
+	var state State
+	err = withContext(ctx, func() (err error) {
+		state, err = runAlgorithm(client, key, limit, n, write, now)
+		return err
+	})
+	if err != nil {
+		return State{}, err
+	}
+	return state, nil
+}
+
+// runAlgorithm runs the script of the limit's algorithm.
+func runAlgorithm(client *redis.Client, key string, limit Limit, n int64, write bool, now time.Time) (State, error) {
+	if !write && limit.algorithm() == TokenBucket {
+		return peekTokenBucket(client, key, limit, now)
+	}
+
+	call := algorithmCall(key, limit, n, now)
+	rs, err := runScript(client, call.script, call.keys, call.size, append(call.args, writeFlag(write))...)
+	if err != nil {
+		return State{}, err
+	}
+	return call.parse(rs)
+}
+
+// scriptCall is a run of the script of an algorithm on a bucket, with the arguments preceding its write flag.
+type scriptCall struct {
+	script *redis.Script
+	keys   []string
+	args   []interface{}
+
+	// Number of values replied by the script, and their state.
+	size  int
+	parse func(rs []interface{}) (State, error)
+}
+
+// algorithmCall returns the run of the script of the limit's algorithm taking n tokens from the bucket of key.
+func algorithmCall(key string, limit Limit, n int64, now time.Time) scriptCall {
+	switch limit.algorithm() {
+	case SlidingWindowLog:
+		return slidingLogCall(key, limit, n, now)
+	case SlidingWindowCounter:
+		return slidingCounterCall(key, limit, n, now)
+	case GCRA:
+		return gcraCall(key, limit, n, now)
+	case FixedWindow:
+		return fixedWindowCall(key, limit, n, now)
+	default:
+		return tokenBucketCall(key, limit, n, now)
+	}
+}
+
+func peekTokenBucket(client *redis.Client, key string, limit Limit, now time.Time) (State, error) {
+	result, err := peekScript.Run(client, bucketKeys(key), refillRate(limit), limit.Max, unixSeconds(now)).Result()
+	if err != nil {
+		return State{}, err
+	}
+	tokens, err := parseTokens(result)
+	if err != nil {
+		return State{}, err
+	}
+	return wholeSecondState(tokenBucketState(tokens >= 1, tokens, limit, 1, now), now), nil
+}
+
+func tokenBucketCall(key string, limit Limit, n int64, now time.Time) scriptCall {
+	return scriptCall{
+		script: takeScript,
+		keys:   bucketKeys(key),
+		args:   []interface{}{refillRate(limit), limit.Max, unixSeconds(now), n},
+		size:   2,
+		parse: func(rs []interface{}) (State, error) {
+			tokens, err := parseTokens(rs[1])
+			if err != nil {
+				return State{}, err
+			}
+			return wholeSecondState(tokenBucketState(rs[0] == int64(1), tokens, limit, n, now), now), nil
+		},
+	}
+}
+
+// wholeSecondState delays the refill times of a token bucket state to the whole seconds
+// the bucket is refilled on.
+func wholeSecondState(state State, now time.Time) State {
+	second := time.Unix(now.Unix(), 0)
+	ceil := func(d time.Duration) time.Duration {
+		return (d + time.Second - 1) / time.Second * time.Second
+	}
+	if state.RetryAfter > 0 {
+		state.RetryAfter = second.Add(ceil(state.RetryAfter)).Sub(now)
+	}
+	if state.ResetAt.After(now) {
+		state.ResetAt = second.Add(ceil(state.ResetAt.Sub(now)))
+	}
+	return state
+}
+
+func slidingLogCall(key string, limit Limit, n int64, now time.Time) scriptCall {
+	return scriptCall{
+		script: slidingLogScript,
+		keys:   []string{key + ".log", key + ".seq"},
+		args:   []interface{}{limit.Max, limit.TTL.Microseconds(), now.UnixMicro(), n},
+		size:   4,
+		parse: func(rs []interface{}) (State, error) {
+			count, ok := rs[1].(int64)
+			if !ok {
+				return State{}, fmt.Errorf("unexpected redis reply %v", rs)
+			}
+			released, err := parseMicros(rs[2])
+			if err != nil {
+				return State{}, err
+			}
+			newest, err := parseMicros(rs[3])
+			if err != nil {
+				return State{}, err
+			}
+
+			return slidingLogState(rs[0] == int64(1), count, released, newest, limit, now), nil
+		},
+	}
+}
+
+func slidingCounterCall(key string, limit Limit, n int64, now time.Time) scriptCall {
+	return scriptCall{
+		script: slidingCounterScript,
+		keys:   []string{key + ".swc"},
+		args:   []interface{}{limit.Max, limit.TTL.Microseconds(), now.UnixMicro(), n},
+		size:   4,
+		parse: func(rs []interface{}) (State, error) {
+			prev, okPrev := rs[1].(int64)
+			curr, okCurr := rs[2].(int64)
+			window, okWindow := rs[3].(int64)
+			if !okPrev || !okCurr || !okWindow {
+				return State{}, fmt.Errorf("unexpected redis reply %v", rs)
+			}
+
+			return slidingCounterState(rs[0] == int64(1), prev, curr, time.UnixMicro(window), limit, n, now), nil
+		},
+	}
+}
+
+func gcraCall(key string, limit Limit, n int64, now time.Time) scriptCall {
+	return scriptCall{
+		script: gcraScript,
+		keys:   []string{key + ".gcra"},
+		args:   []interface{}{limit.TTL.Microseconds(), gcraBurst(limit).Microseconds(), now.UnixMicro(), n},
+		size:   2,
+		parse: func(rs []interface{}) (State, error) {
+			tat, ok := rs[1].(int64)
+			if !ok {
+				return State{}, fmt.Errorf("unexpected redis reply %v", rs)
+			}
+
+			return gcraState(rs[0] == int64(1), time.UnixMicro(tat), limit, n, now), nil
+		},
+	}
+}
+
+func fixedWindowCall(key string, limit Limit, n int64, now time.Time) scriptCall {
+	return scriptCall{
+		script: fixedWindowScript,
+		keys:   []string{key + ".fw"},
+		args:   []interface{}{limit.Max, limit.TTL.Milliseconds(), n},
+		size:   3,
+		parse: func(rs []interface{}) (State, error) {
+			count, okCount := rs[1].(int64)
+			ttl, okTTL := rs[2].(int64)
+			if !okCount || !okTTL {
+				return State{}, fmt.Errorf("unexpected redis reply %v", rs)
+			}
+
+			return fixedWindowState(rs[0] == int64(1), count, now.Add(time.Duration(ttl)*time.Millisecond), limit, n, now), nil
+		},
+	}
+}
+
+// runScript runs script and checks that it replied with size values.
+func runScript(client *redis.Client, script *redis.Script, keys []string, size int, args ...interface{}) ([]interface{}, error) {
+	results, err := script.Run(client, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	rs, ok := results.([]interface{})
+	if !ok || len(rs) != size {
+		return nil, fmt.Errorf("unexpected redis reply %v", results)
+	}
+	return rs, nil
+}
+
+// Refund gives back n tokens taken from the bucket identified by key.
+func (s *Redis) Refund(ctx context.Context, key string, limit Limit, n int64) error {
+	if limit.TTL <= 0 {
+		return nil
+	}
+
+	client, err := s.clientWithContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var refundKey string
+	var param interface{}
+	switch limit.algorithm() {
+	case SlidingWindowLog:
+		refundKey = key + ".log"
+	case SlidingWindowCounter:
+		refundKey = key + ".swc"
+	case GCRA:
+		refundKey, param = key+".gcra", limit.TTL.Microseconds()
+	case FixedWindow:
+		refundKey = key + ".fw"
+	default:
+		refundKey, param = bucketKeys(key)[0], limit.Max
+	}
+
+	return withContext(ctx, func() error {
+		return refundScript.Run(client, []string{refundKey}, limit.algorithm().String(), n, param).Err()
+	})
+}
+
+// Reset refills the bucket identified by key.
+func (s *Redis) Reset(ctx context.Context, key string) error {
+	client, err := s.clientWithContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return withContext(ctx, func() error {
+		return client.Del(append(bucketKeys(key), key+".log", key+".seq", key+".swc", key+".gcra", key+".fw")...).Err()
+	})
+}
+
+func (s *Redis) clientWithContext(ctx context.Context) (*redis.Client, error) {
+	if s.client == nil {
+		return nil, errors.New("redis client is nil")
+	}
+	return s.client.WithContext(ctx), nil
+}
+
+// withContext runs call and returns as soon as ctx is done, because go-redis does not interrupt
+// commands on context cancellation. The command then keeps running in the background and its reply
+// is dropped, call must not write anything read after an error.
+func withContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return call()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- call() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseTokens reads the number of tokens returned as a string by the scripts.
+func parseTokens(reply interface{}) (float64, error) {
+	tokens, ok := reply.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	return strconv.ParseFloat(tokens, 64)
+}
+
+// parseMicros reads a time returned in Unix microseconds by the scripts, the zero time when empty.
+func parseMicros(reply interface{}) (time.Time, error) {
+	micros, ok := reply.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	if micros == "" {
+		return time.Time{}, nil
+	}
+	value, err := strconv.ParseFloat(micros, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMicro(int64(value)), nil
+}
+
+func writeFlag(write bool) string {
+	if write {
+		return "1"
+	}
+	return "0"
+}
+
+func bucketKeys(key string) []string {
+	return []string{key + ".tokens", key + ".ts"}
+}
+
+// refillRate returns the number of tokens added to the bucket per second.
+func refillRate(limit Limit) string {
+	return strconv.FormatFloat(1/limit.TTL.Seconds(), 'f', -1, 64)
+}
+
+// unixSeconds returns the timestamp of t in whole seconds, as github.com/aw16com/rate/redis writes it.
+func unixSeconds(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
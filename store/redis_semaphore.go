@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	redis "github.com/go-redis/redis"
+)
+
+// acquireScript keeps the slots of a semaphore in a sorted set scored by their expiry, in milliseconds.
+// Expired slots are dropped before counting.
+var acquireScript = redis.NewScript(`
+local leases_key = KEYS[1]
+
+local capacity = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local id = ARGV[4]
+
+redis.call("zremrangebyscore", leases_key, "-inf", now)
+local count = redis.call("zcard", leases_key)
+if count >= capacity then
+    return { 0, count }
+end
+
+redis.call("zadd", leases_key, now+ttl, id)
+redis.call("pexpire", leases_key, ttl)
+
+return { 1, count+1 }
+`)
+
+// RedisSemaphore is a Semaphore that keeps slots in redis, shared by every process using the same server.
+// Slots are leases: they are freed after their ttl when the process holding them dies.
+type RedisSemaphore struct {
+	client *redis.Client
+}
+
+// NewRedisSemaphore is a constructor for RedisSemaphore.
+func NewRedisSemaphore(client *redis.Client) *RedisSemaphore {
+	return &RedisSemaphore{client: client}
+}
+
+// Acquire takes one of the max slots of the semaphore identified by key.
+// A non-positive ttl is not supported by redis leases, they then expire after a minute.
+// A slot acquired by redis after ctx is done is only freed when its lease expires.
+func (s *RedisSemaphore) Acquire(ctx context.Context, key string, max int64, ttl time.Duration) (Lease, error) {
+	if s.client == nil {
+		return Lease{}, errors.New("redis client is nil")
+	}
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+
+	now := time.Now()
+	lease := Lease{Key: key, ID: newLeaseID(), ExpiresAt: now.Add(ttl)}
+	var results interface{}
+	err := withContext(ctx, func() (err error) {
+		results, err = acquireScript.Run(s.client.WithContext(ctx), []string{key + ".leases"},
+			max, now.UnixMilli(), ttl.Milliseconds(), lease.ID).Result()
+		return err
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+
+	rs, ok := results.([]interface{})
+	if !ok || len(rs) != 2 {
+		return Lease{}, fmt.Errorf("unexpected redis reply %v", results)
+	}
+	if lease.InFlight, ok = rs[1].(int64); !ok {
+		return Lease{}, fmt.Errorf("unexpected redis reply %v", results)
+	}
+
+	lease.Acquired = rs[0] == int64(1)
+	if !lease.Acquired {
+		lease.ID, lease.ExpiresAt = "", time.Time{}
+	}
+	return lease, nil
+}
+
+// Release frees the slot held by lease.
+func (s *RedisSemaphore) Release(ctx context.Context, lease Lease) error {
+	if s.client == nil {
+		return errors.New("redis client is nil")
+	}
+	return withContext(ctx, func() error {
+		return s.client.WithContext(ctx).ZRem(lease.Key+".leases", lease.ID).Err()
+	})
+}
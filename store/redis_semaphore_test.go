@@ -0,0 +1,40 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRedisSemaphore(t *testing.T) {
+	s := NewRedisSemaphore(newTestRedis(t).Client())
+	ctx := context.Background()
+	key := "TestRedisSemaphore"
+	s.client.Del(key + ".leases")
+
+	first, err := s.Acquire(ctx, key, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire should not fail. Error: %v", err)
+	}
+	if !first.Acquired || first.InFlight != 1 {
+		t.Errorf("First acquire should be allowed. Lease: %+v", first)
+	}
+
+	if lease, _ := s.Acquire(ctx, key, 1, time.Minute); lease.Acquired {
+		t.Errorf("Second acquire should not be allowed while the slot is leased. Lease: %+v", lease)
+	}
+
+	if err := s.Release(ctx, first); err != nil {
+		t.Fatalf("Release should not fail. Error: %v", err)
+	}
+	if lease, _ := s.Acquire(ctx, key, 1, time.Minute); !lease.Acquired {
+		t.Error("Acquire should be allowed once the slot is released.")
+	}
+}
+
+func TestRedisSemaphoreWithoutClient(t *testing.T) {
+	s := NewRedisSemaphore(nil)
+	if _, err := s.Acquire(context.Background(), "TestRedisSemaphoreWithoutClient", 1, time.Second); err == nil {
+		t.Error("Acquire should fail without a redis client.")
+	}
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	rate "github.com/aw16com/rate/redis"
+	"github.com/go-redis/redis"
+)
+
+func newTestRedis(t *testing.T) *Redis {
+	s, err := NewRedisFromConfig(&rate.ConfigRedis{
+		Host: "127.0.0.1",
+		Port: 6379,
+		Auth: "",
+	})
+	if err != nil {
+		t.Skipf("redis is not reachable. Error: %v", err)
+	}
+	return s
+}
+
+func TestRedisTake(t *testing.T) {
+	s := newTestRedis(t)
+	ctx := context.Background()
+	key := "TestRedisTake"
+	limit := Limit{Max: 2, TTL: time.Second}
+	s.Reset(ctx, key)
+
+	for i := 0; i < 2; i++ {
+		state, err := s.Take(ctx, key, limit, 1)
+		if err != nil {
+			t.Fatalf("Take should not fail. Error: %v", err)
+		}
+		if !state.Allowed {
+			t.Errorf("N(%v) take should be allowed.", i)
+		}
+		if state.Remaining != int64(1-i) {
+			t.Errorf("N(%v) take left the wrong number of tokens. Remaining: %v", i, state.Remaining)
+		}
+	}
+
+	state, _ := s.Take(ctx, key, limit, 1)
+	if state.Allowed {
+		t.Error("Third take should not be allowed because the bucket is empty.")
+	}
+}
+
+// TestRedisBurst checks that, like github.com/aw16com/rate/redis, a burst within a second is not refilled.
+func TestRedisBurst(t *testing.T) {
+	s := newTestRedis(t)
+	ctx := context.Background()
+	key := "TestRedisBurst"
+	limit := Limit{Max: 500, TTL: time.Second / 500}
+	s.Reset(ctx, key)
+
+	now := time.Unix(time.Now().Unix(), 0)
+	for i := 0; i < 500; i++ {
+		if state, _ := runAlgorithm(s.Client(), key, limit, 1, true, now.Add(time.Duration(i)*time.Millisecond)); !state.Allowed {
+			t.Fatalf("N(%v) take should be allowed.", i)
+		}
+	}
+	state, _ := runAlgorithm(s.Client(), key, limit, 1, true, now.Add(999*time.Millisecond))
+	if state.Allowed {
+		t.Error("Take should not be allowed before the bucket is refilled on the next second.")
+	}
+	if state.RetryAfter != time.Millisecond {
+		t.Errorf("Take should be retried on the next second. RetryAfter: %v", state.RetryAfter)
+	}
+}
+
+func TestWholeSecondState(t *testing.T) {
+	now := time.Unix(100, int64(300*time.Millisecond))
+	state := wholeSecondState(State{RetryAfter: 2 * time.Millisecond, ResetAt: now.Add(1500 * time.Millisecond)}, now)
+	if state.RetryAfter != 700*time.Millisecond {
+		t.Errorf("RetryAfter should last until the next whole second. RetryAfter: %v", state.RetryAfter)
+	}
+	if !state.ResetAt.Equal(time.Unix(102, 0)) {
+		t.Errorf("ResetAt should be a whole second. ResetAt: %v", state.ResetAt)
+	}
+}
+
+func TestRedisPeekAndReset(t *testing.T) {
+	s := newTestRedis(t)
+	ctx := context.Background()
+	key := "TestRedisPeekAndReset"
+	limit := Limit{Max: 1, TTL: time.Second}
+	s.Reset(ctx, key)
+
+	s.Take(ctx, key, limit, 1)
+	state, err := s.Peek(ctx, key, limit)
+	if err != nil {
+		t.Fatalf("Peek should not fail. Error: %v", err)
+	}
+	if state.Allowed || state.Remaining != 0 {
+		t.Errorf("Peek should report an empty bucket. State: %+v", state)
+	}
+
+	if err := s.Reset(ctx, key); err != nil {
+		t.Fatalf("Reset should not fail. Error: %v", err)
+	}
+	state, _ = s.Peek(ctx, key, limit)
+	if !state.Allowed || state.Remaining != 1 {
+		t.Errorf("Peek should report a full bucket after Reset. State: %+v", state)
+	}
+}
+
+func TestRedisAlgorithms(t *testing.T) {
+	s := newTestRedis(t)
+	ctx := context.Background()
+
+	for _, algorithm := range []Algorithm{SlidingWindowLog, SlidingWindowCounter, GCRA, FixedWindow} {
+		key := "TestRedisAlgorithms" + algorithm.String()
+		limit := Limit{Max: 2, TTL: time.Minute, Algorithm: algorithm}
+		s.Reset(ctx, key)
+
+		for i := 0; i < 2; i++ {
+			state, err := s.Take(ctx, key, limit, 1)
+			if err != nil {
+				t.Fatalf("%v take should not fail. Error: %v", algorithm, err)
+			}
+			if !state.Allowed || state.Remaining != int64(1-i) {
+				t.Errorf("N(%v) %v take should be allowed. State: %+v", i, algorithm, state)
+			}
+		}
+
+		state, _ := s.Take(ctx, key, limit, 1)
+		if state.Allowed || state.RetryAfter <= 0 {
+			t.Errorf("Third %v take should not be allowed. State: %+v", algorithm, state)
+		}
+		if state, _ := s.Peek(ctx, key, limit); state.Allowed {
+			t.Errorf("%v peek should report that the limit is reached. State: %+v", algorithm, state)
+		}
+
+		s.Reset(ctx, key)
+		if state, _ := s.Take(ctx, key, limit, 1); !state.Allowed {
+			t.Errorf("%v take should be allowed after Reset.", algorithm)
+		}
+	}
+}
+
+func TestRedisRefund(t *testing.T) {
+	s := newTestRedis(t)
+	ctx := context.Background()
+
+	for _, algorithm := range []Algorithm{TokenBucket, SlidingWindowLog, SlidingWindowCounter, GCRA, FixedWindow} {
+		key := "TestRedisRefund" + algorithm.String()
+		limit := Limit{Max: 2, TTL: time.Minute, Algorithm: algorithm}
+		s.Reset(ctx, key)
+
+		s.Take(ctx, key, limit, 2)
+		if err := s.Refund(ctx, key, limit, 1); err != nil {
+			t.Fatalf("%v refund should not fail. Error: %v", algorithm, err)
+		}
+		if state, _ := s.Peek(ctx, key, limit); !state.Allowed || state.Remaining != 1 {
+			t.Errorf("%v refund should give back one request. State: %+v", algorithm, state)
+		}
+	}
+}
+
+func TestRedisWithoutClient(t *testing.T) {
+	s := NewRedis(nil)
+	if _, err := s.Take(context.Background(), "TestRedisWithoutClient", Limit{Max: 1, TTL: time.Second}, 1); err == nil {
+		t.Error("Take should fail without a redis client.")
+	}
+}
+
+func TestRedisContext(t *testing.T) {
+	// A server accepting connections and never replying, like a partitioned redis.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	s := NewRedis(redis.NewClient(&redis.Options{Addr: listener.Addr().String(), ReadTimeout: time.Minute}))
+	defer s.Client().Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := s.Take(ctx, "TestRedisContext", Limit{Max: 1, TTL: time.Second}, 1); err != context.DeadlineExceeded {
+		t.Errorf("Take should fail with the context. Error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Take should return at the deadline. Elapsed: %v", elapsed)
+	}
+
+	if err := s.Reset(ctx, "TestRedisContext"); err != context.DeadlineExceeded {
+		t.Errorf("Reset should fail once the context is done. Error: %v", err)
+	}
+}
+
+func TestRedisTakeAll(t *testing.T) {
+	testTakeAll(t, newTestRedis(t), "TestRedisTakeAll")
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Lease is a slot of a Semaphore held by an in-flight request.
+type Lease struct {
+	// Key of the semaphore.
+	Key string
+
+	// Identifier of the slot, used to release it.
+	ID string
+
+	// Whether the slot was acquired. Every slot was held by other requests otherwise.
+	Acquired bool
+
+	// Number of slots held, including this one when it was acquired.
+	InFlight int64
+
+	// Time at which the slot is freed if it has not been released.
+	ExpiresAt time.Time
+}
+
+// Semaphore limits the number of slots held at once per key.
+type Semaphore interface {
+	// Acquire takes one of the max slots of the semaphore identified by key.
+	// The slot is freed after ttl if it is not released, a non-positive ttl never frees it.
+	Acquire(ctx context.Context, key string, max int64, ttl time.Duration) (Lease, error)
+
+	// Release frees the slot held by lease.
+	Release(ctx context.Context, lease Lease) error
+}
+
+// LocalSemaphore is a Semaphore that keeps slots in the memory of the process.
+type LocalSemaphore struct {
+	leases map[string]map[string]time.Time
+	now    func() time.Time
+
+	sync.Mutex
+}
+
+// NewLocalSemaphore is a constructor for LocalSemaphore.
+func NewLocalSemaphore() *LocalSemaphore {
+	return &LocalSemaphore{
+		leases: make(map[string]map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Acquire takes one of the max slots of the semaphore identified by key.
+func (s *LocalSemaphore) Acquire(ctx context.Context, key string, max int64, ttl time.Duration) (Lease, error) {
+	now := s.now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	leases := s.leases[key]
+	for id, expires := range leases {
+		if !expires.IsZero() && !expires.After(now) {
+			delete(leases, id)
+		}
+	}
+
+	lease := Lease{Key: key, InFlight: int64(len(leases))}
+	if lease.InFlight >= max {
+		return lease, nil
+	}
+
+	lease.ID = newLeaseID()
+	lease.Acquired = true
+	lease.InFlight++
+	if ttl > 0 {
+		lease.ExpiresAt = now.Add(ttl)
+	}
+
+	if leases == nil {
+		leases = make(map[string]time.Time)
+		s.leases[key] = leases
+	}
+	leases[lease.ID] = lease.ExpiresAt
+	return lease, nil
+}
+
+// Release frees the slot held by lease.
+func (s *LocalSemaphore) Release(ctx context.Context, lease Lease) error {
+	s.Lock()
+	defer s.Unlock()
+
+	leases := s.leases[lease.Key]
+	delete(leases, lease.ID)
+	if len(leases) == 0 {
+		delete(s.leases, lease.Key)
+	}
+	return nil
+}
+
+// newLeaseID returns a random identifier, unique across processes sharing a semaphore.
+func newLeaseID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalSemaphore(t *testing.T) {
+	s := NewLocalSemaphore()
+	ctx := context.Background()
+	key := "TestLocalSemaphore"
+
+	var leases []Lease
+	for i := 0; i < 2; i++ {
+		lease, _ := s.Acquire(ctx, key, 2, 0)
+		if !lease.Acquired || lease.InFlight != int64(i+1) {
+			t.Errorf("N(%v) acquire should be allowed. Lease: %+v", i, lease)
+		}
+		leases = append(leases, lease)
+	}
+
+	if lease, _ := s.Acquire(ctx, key, 2, 0); lease.Acquired || lease.InFlight != 2 {
+		t.Errorf("Third acquire should not be allowed while 2 slots are held. Lease: %+v", lease)
+	}
+
+	s.Release(ctx, leases[0])
+	if lease, _ := s.Acquire(ctx, key, 2, 0); !lease.Acquired {
+		t.Error("Acquire should be allowed once a slot is released.")
+	}
+}
+
+func TestLocalSemaphoreExpiry(t *testing.T) {
+	s := NewLocalSemaphore()
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+	key := "TestLocalSemaphoreExpiry"
+
+	s.Acquire(ctx, key, 1, time.Second)
+	if lease, _ := s.Acquire(ctx, key, 1, time.Second); lease.Acquired {
+		t.Error("Acquire should not be allowed while the slot is leased.")
+	}
+
+	now = now.Add(time.Second)
+	lease, _ := s.Acquire(ctx, key, 1, time.Second)
+	if !lease.Acquired || !lease.ExpiresAt.Equal(now.Add(time.Second)) {
+		t.Errorf("Acquire should be allowed once the lease expired. Lease: %+v", lease)
+	}
+
+	s.Release(ctx, lease)
+	if len(s.leases) != 0 {
+		t.Errorf("Keys without slots should be dropped. Leases: %v", s.leases)
+	}
+}
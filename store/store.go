@@ -0,0 +1,69 @@
+// Package store provides backends that keep the state of rate-limit buckets.
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Limit defines the capacity and refill interval of a token bucket.
+type Limit struct {
+	// Maximum number of tokens the bucket holds.
+	Max int64
+
+	// Interval between two refilled tokens, or length of the window of the sliding algorithms.
+	// A non-positive TTL never runs out of tokens. Redis refills token buckets on whole seconds,
+	// see TokenBucket.
+	TTL time.Duration
+
+	// How requests are counted. Default is TokenBucket.
+	Algorithm Algorithm
+}
+
+// State reports the state of a bucket after a store operation.
+type State struct {
+	// Whether the requested tokens were taken.
+	Allowed bool
+
+	// Number of whole tokens left in the bucket.
+	Remaining int64
+
+	// Time at which the bucket is full again.
+	ResetAt time.Time
+
+	// Duration to wait before the requested tokens are available, zero when they were taken.
+	RetryAfter time.Duration
+}
+
+// unlimitedState returns the state of a bucket with a non-positive TTL.
+func unlimitedState(limit Limit, now time.Time) State {
+	return State{Allowed: true, Remaining: limit.Max, ResetAt: now}
+}
+
+// Store keeps token buckets identified by key.
+type Store interface {
+	// Take removes n tokens from the bucket identified by key when they are available.
+	Take(ctx context.Context, key string, limit Limit, n int64) (State, error)
+
+	// Peek reports the state of the bucket identified by key without taking any token.
+	Peek(ctx context.Context, key string, limit Limit) (State, error)
+
+	// Reset refills the bucket identified by key.
+	Reset(ctx context.Context, key string) error
+}
+
+// Refunder is implemented by stores that can give back tokens, when a request taken from
+// a bucket is finally rejected by another limit.
+type Refunder interface {
+	// Refund gives back n tokens taken from the bucket identified by key.
+	Refund(ctx context.Context, key string, limit Limit, n int64) error
+}
+
+// MultiTaker is implemented by stores that take tokens from several buckets at once, so that a request
+// limited by several limits takes tokens from all of their buckets or from none of them.
+type MultiTaker interface {
+	// TakeAll removes n tokens from every bucket of keys, limited by the limit of the same index,
+	// when all of them are available. It returns the state of every bucket, nothing is taken
+	// when one of them is not Allowed.
+	TakeAll(ctx context.Context, keys []string, limits []Limit, n int64) ([]State, error)
+}
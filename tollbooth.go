@@ -2,20 +2,26 @@
 package tollbooth
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	rate "github.com/aw16com/rate/redis"
 	"github.com/aw16com/tollbooth/config"
 	"github.com/aw16com/tollbooth/errors"
-	"github.com/aw16com/tollbooth/libstring"
+	"github.com/aw16com/tollbooth/store"
 )
 
 var (
-	settings []config.RateLimit
+	// Rate limits registered with the deprecated RegisterAPI, shared by every limiter.
+	defaultRules = config.NewRouter()
+
+	deprecatedOnce sync.Once
 )
 
 // NewLimiter is a convenience function to config.NewLimiter.
@@ -23,118 +29,222 @@ func NewLimiter(max int64, ttl time.Duration, conf *rate.ConfigRedis) *config.Li
 	return config.NewLimiter(max, ttl, conf)
 }
 
+// NewLimiterWithStore is a convenience function to config.NewLimiterWithStore.
+func NewLimiterWithStore(max int64, ttl time.Duration, s store.Store) *config.Limiter {
+	return config.NewLimiterWithStore(max, ttl, s)
+}
+
 // LimitByKeys keeps track number of request made by keys separated by pipe.
 // It returns HTTPError when limit is exceeded.
 func LimitByKeys(limiter *config.Limiter, keys []string, limitVal *config.LimitValue) *errors.HTTPError {
-	if limiter.LimitReached(strings.Join(keys, "|"), limitVal) {
-		return &errors.HTTPError{Message: limiter.Message, StatusCode: limiter.StatusCode}
+	return LimitByKeysContext(context.Background(), limiter, keys, limitVal)
+}
+
+// LimitByKeysContext is LimitByKeys calling the store with ctx.
+// The limiter's FailurePolicy decides when ctx is done before the store answers.
+func LimitByKeysContext(ctx context.Context, limiter *config.Limiter, keys []string, limitVal *config.LimitValue) *errors.HTTPError {
+	_, httpError := LimitByKeysWithResultContext(ctx, limiter, keys, limitVal)
+	return httpError
+}
+
+// LimitByKeysWithResult is LimitByKeys also returning the decision taken on the bucket.
+func LimitByKeysWithResult(limiter *config.Limiter, keys []string, limitVal *config.LimitValue) (*config.Result, *errors.HTTPError) {
+	return LimitByKeysWithResultContext(context.Background(), limiter, keys, limitVal)
+}
+
+// LimitByKeysWithResultContext is LimitByKeysWithResult calling the store with ctx.
+func LimitByKeysWithResultContext(ctx context.Context, limiter *config.Limiter, keys []string, limitVal *config.LimitValue) (*config.Result, *errors.HTTPError) {
+	return LimitByKeysWithCostContext(ctx, limiter, keys, limitVal, 1)
+}
+
+// LimitByKeysWithCost is LimitByKeysWithResult taking cost tokens at once, at least one.
+func LimitByKeysWithCost(limiter *config.Limiter, keys []string, limitVal *config.LimitValue, cost int64) (*config.Result, *errors.HTTPError) {
+	return LimitByKeysWithCostContext(context.Background(), limiter, keys, limitVal, cost)
+}
+
+// LimitByKeysWithCostContext is LimitByKeysWithCost calling the store with ctx.
+func LimitByKeysWithCostContext(ctx context.Context, limiter *config.Limiter, keys []string, limitVal *config.LimitValue, cost int64) (*config.Result, *errors.HTTPError) {
+	return limitError(limiter, limiter.AllowNContext(ctx, strings.Join(keys, "|"), limitVal, cost))
+}
+
+// limitError returns the HTTPError of result when it is not allowed.
+func limitError(limiter *config.Limiter, result *config.Result) (*config.Result, *errors.HTTPError) {
+	if !result.Allowed {
+		return result, &errors.HTTPError{Message: limiter.Message, StatusCode: limiter.StatusCode}
 	}
 
-	return nil
+	return result, nil
 }
 
 // LimitByRequest builds keys based on http.Request struct,
 // loops through all the keys, and check if any one of them returns HTTPError.
+// The store is called with the context of r, so that it gives up once the client is gone.
 func LimitByRequest(limiter *config.Limiter, r *http.Request) *errors.HTTPError {
+	_, httpError := LimitByRequestWithResult(limiter, r)
+	return httpError
+}
+
+// LimitByRequestWithResult is LimitByRequest also returning the decision of the denying bucket,
+// or of the allowing bucket with the fewest requests left. The result is nil when no key applies.
+func LimitByRequestWithResult(limiter *config.Limiter, r *http.Request) (*config.Result, *errors.HTTPError) {
+	return limitByRequest(limiter, r, func(key string, rule *config.RateLimit, cost int64) *config.Result {
+		return limiter.AllowRuleNContext(r.Context(), key, rule, cost)
+	})
+}
+
+// WaitByRequest is LimitByRequestWithResult delaying the request until its tokens are available,
+// for at most limiter.MaxWait and as long as the request context is not done, rather than rejecting it.
+func WaitByRequest(limiter *config.Limiter, r *http.Request) (*config.Result, *errors.HTTPError) {
+	ctx := r.Context()
+	if limiter.MaxWait > 0 {
+		// Every key shares the same maximum wait.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limiter.MaxWait)
+		defer cancel()
+	}
+
+	return limitByRequest(limiter, r, func(key string, rule *config.RateLimit, cost int64) *config.Result {
+		return limiter.WaitRuleN(ctx, key, rule, cost)
+	})
+}
+
+// limitByRequest takes the decision of every key of r with decide.
+func limitByRequest(limiter *config.Limiter, r *http.Request, decide func(key string, rule *config.RateLimit, cost int64) *config.Result) (*config.Result, *errors.HTTPError) {
+	r = config.WithClaimsCache(r)
 	sliceKeys := BuildKeys(limiter, r)
+	rule := limiter.LimitRule(r, matchLimit(limiter, r))
+	cost := limiter.Cost(r, rule)
 
 	// Loop sliceKeys and check if one of them has error.
+	var mostRestrictive *config.Result
 	for _, keys := range sliceKeys {
-		httpError := LimitByKeys(limiter, keys, matchLimit(r))
+		result, httpError := limitError(limiter, decide(strings.Join(keys, "|"), rule, cost))
 		if httpError != nil {
-			return httpError
+			return result, httpError
+		}
+		if mostRestrictive == nil || result.Remaining < mostRestrictive.Remaining {
+			mostRestrictive = result
 		}
 	}
 
-	return nil
+	return mostRestrictive, nil
 }
 
 // BuildKeys generates a slice of keys to rate-limit by given config and request structs.
+// See config.Limiter.Keys.
 func BuildKeys(limiter *config.Limiter, r *http.Request) [][]string {
-	remoteIP := libstring.RemoteIP(limiter.IPLookups, r)
-	path := r.URL.Path
-	sliceKeys := make([][]string, 0)
-
-	// Don't BuildKeys if remoteIP is blank.
-	if remoteIP == "" {
-		return sliceKeys
-	}
-
-	if limiter.Methods != nil && limiter.Headers != nil && limiter.BasicAuthUsers != nil {
-		// Limit by HTTP methods and HTTP headers+values and Basic Auth credentials.
-		if libstring.StringInSlice(limiter.Methods, r.Method) {
-			for _, headerKey := range limiter.Headers {
-				if r.Header.Get(headerKey) != "" {
-					// If header values are empty, rate-limit all request with headerValue.
-					username, _, ok := r.BasicAuth()
-					if ok && libstring.StringInSlice(limiter.BasicAuthUsers, username) {
-						sliceKeys = append(sliceKeys, []string{remoteIP, path, r.Method, headerKey, r.Header.Get(headerKey), username})
-					}
-
-				}
-			}
-		}
-	} else if limiter.Methods != nil && limiter.Headers != nil {
-		// Limit by HTTP methods and HTTP headers+values.
-		if libstring.StringInSlice(limiter.Methods, r.Method) {
-			for _, headerKey := range limiter.Headers {
-				if r.Header.Get(headerKey) != "" {
-					// If header values are empty, rate-limit all request with headerKey.
-					sliceKeys = append(sliceKeys, []string{remoteIP, path, r.Method, headerKey, r.Header.Get(headerKey)})
-				}
-			}
-		}
-	} else if limiter.Methods != nil && limiter.BasicAuthUsers != nil {
-		// Limit by HTTP methods and Basic Auth credentials.
-		if libstring.StringInSlice(limiter.Methods, r.Method) {
-			username, _, ok := r.BasicAuth()
-			if ok && libstring.StringInSlice(limiter.BasicAuthUsers, username) {
-				sliceKeys = append(sliceKeys, []string{remoteIP, path, r.Method, username})
-			}
-		}
-	} else if limiter.Methods != nil {
-		// Limit by HTTP methods.
-		if libstring.StringInSlice(limiter.Methods, r.Method) {
-			sliceKeys = append(sliceKeys, []string{remoteIP, path, r.Method})
+	return limiter.Keys(r)
+}
+
+// SetResponseHeaders configures X-Rate-Limit-Limit and X-Rate-Limit-Duration.
+func SetResponseHeaders(limiter *config.Limiter, w http.ResponseWriter) {
+	w.Header().Add("X-Rate-Limit-Limit", strconv.FormatInt(limiter.Max, 10))
+	w.Header().Add("X-Rate-Limit-Duration", limiter.TTL.String())
+}
+
+// SetResultHeaders configures the rate-limit headers selected by limiter.HeaderStyle
+// from the bucket consulted for result, and Retry-After when the request was rejected.
+// The limiter defaults are reported when result is nil. No window applies to a rejection by
+// MaxInFlight, so X-Rate-Limit-Duration and RateLimit-Policy are left out of it.
+func SetResultHeaders(limiter *config.Limiter, w http.ResponseWriter, result *config.Result) {
+	if result == nil {
+		result = &config.Result{
+			Allowed:   true,
+			Limit:     config.LimitValue{Max: limiter.Max, TTL: limiter.TTL, Algorithm: limiter.Algorithm},
+			Remaining: limiter.Max,
+			ResetAt:   time.Now(),
 		}
-	} else if limiter.Headers != nil {
-		// Limit by HTTP headers+values.
-		for _, headerKey := range limiter.Headers {
-			if r.Header.Get(headerKey) != "" {
-				// If header values are empty, rate-limit all request with headerKey.
-				sliceKeys = append(sliceKeys, []string{remoteIP, path, headerKey, r.Header.Get(headerKey)})
-			}
+	}
+	header := w.Header()
+
+	if limiter.HeaderStyle&config.LegacyHeaders != 0 {
+		header.Set("X-Rate-Limit-Limit", strconv.FormatInt(result.Limit.Max, 10))
+		if !result.InFlightRejected {
+			header.Set("X-Rate-Limit-Duration", result.Limit.TTL.String())
 		}
-	} else if limiter.BasicAuthUsers != nil {
-		// Limit by Basic Auth credentials.
-		username, _, ok := r.BasicAuth()
-		if ok && libstring.StringInSlice(limiter.BasicAuthUsers, username) {
-			sliceKeys = append(sliceKeys, []string{remoteIP, path, username})
+	}
+
+	if limiter.HeaderStyle&config.XRateLimitHeaders != 0 {
+		header.Set("X-RateLimit-Limit", strconv.FormatInt(result.Limit.Max, 10))
+		header.Set("X-RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(ceilUnix(result.ResetAt), 10))
+	}
+
+	if limiter.HeaderStyle&config.IETFHeaders != 0 {
+		if !result.InFlightRejected {
+			header.Set("RateLimit-Policy", fmt.Sprintf(`"default";q=%d;w=%d`, result.Limit.Max, result.WindowSeconds()))
 		}
-	} else {
-		// Default: Limit by remoteIP and path.
-		sliceKeys = append(sliceKeys, []string{remoteIP, path})
+		header.Set("RateLimit", fmt.Sprintf(`"default";r=%d;t=%d`, result.Remaining, result.ResetSeconds()))
 	}
 
-	return sliceKeys
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.FormatInt(result.RetryAfterSeconds(), 10))
+	}
 }
 
-// SetResponseHeaders configures X-Rate-Limit-Limit and X-Rate-Limit-Duration.
-func SetResponseHeaders(limiter *config.Limiter, w http.ResponseWriter) {
-	w.Header().Add("X-Rate-Limit-Limit", strconv.FormatInt(limiter.Max, 10))
-	w.Header().Add("X-Rate-Limit-Duration", limiter.TTL.String())
+// ceilUnix rounds t up to a whole Unix timestamp.
+func ceilUnix(t time.Time) int64 {
+	if t.Nanosecond() > 0 {
+		return t.Unix() + 1
+	}
+	return t.Unix()
+}
+
+// AcquireInFlight takes an in-flight slot for every key of the request, limited by MaxInFlight.
+// It returns the function releasing the slots once the request is handled, or the rejection
+// of the key whose slots are all held, in which case no slot is kept.
+func AcquireInFlight(limiter *config.Limiter, r *http.Request) (func(), *config.Result) {
+	r = config.WithClaimsCache(r)
+	rule := matchLimit(limiter, r)
+
+	var releases []func()
+	release := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	for _, keys := range BuildKeys(limiter, r) {
+		keyRelease, rejected := limiter.AcquireInFlightContext(r.Context(), strings.Join(keys, "|"), rule)
+		if rejected != nil {
+			release()
+			return nil, rejected
+		}
+		releases = append(releases, keyRelease)
+	}
+
+	return release, nil
 }
 
 // LimitHandler is a middleware that performs rate-limiting given http.Handler struct.
+// Requests are limited by MaxInFlight before the rate limit, so that requests rejected
+// because too many are in flight take no token.
 func LimitHandler(limiter *config.Limiter, next http.Handler) http.Handler {
+	return limitHandler(limiter, next, LimitByRequestWithResult)
+}
+
+// WaitHandler is LimitHandler delaying requests over the rate limit with WaitByRequest,
+// for at most limiter.MaxWait, rather than rejecting them at once. Waiting requests hold their in-flight slots.
+func WaitHandler(limiter *config.Limiter, next http.Handler) http.Handler {
+	return limitHandler(limiter, next, WaitByRequest)
+}
+
+func limitHandler(limiter *config.Limiter, next http.Handler, limit func(*config.Limiter, *http.Request) (*config.Result, *errors.HTTPError)) http.Handler {
 	middle := func(w http.ResponseWriter, r *http.Request) {
-		SetResponseHeaders(limiter, w)
+		// The bearer token of r is verified once for the rate limit and the in-flight slots.
+		r = config.WithClaimsCache(r)
+		release, rejected := AcquireInFlight(limiter, r)
+		if rejected != nil {
+			SetResultHeaders(limiter, w, rejected)
+			reject(limiter, w, r, rejected)
+			return
+		}
+		defer release()
+
+		result, httpError := limit(limiter, r)
+		SetResultHeaders(limiter, w, result)
 
-		httpError := LimitByRequest(limiter, r)
 		if httpError != nil {
-			// w.Header().Add("Content-Type", limiter.MessageContentType)
-			w.WriteHeader(httpError.StatusCode)
-			w.Write([]byte(httpError.Message))
+			reject(limiter, w, r, result)
 			return
 		}
 
@@ -145,41 +255,67 @@ func LimitHandler(limiter *config.Limiter, next http.Handler) http.Handler {
 	return http.HandlerFunc(middle)
 }
 
-// RegisterAPI registers rate limit for the specified API.
+// reject writes the response of a rejected request with OnLimitReached, or the renderer of limiter.
+func reject(limiter *config.Limiter, w http.ResponseWriter, r *http.Request, result *config.Result) {
+	if limiter.OnLimitReached != nil {
+		limiter.OnLimitReached(w, r, result)
+		return
+	}
+
+	renderer := limiter.Renderer
+	if renderer == nil {
+		renderer = config.NegotiatedRenderer{}
+	}
+	renderer.Render(w, r, limiter, result)
+}
+
+// RegisterAPI registers rate limit for the specified API on every limiter.
+// Rate limits registered with Limiter.RegisterAPI take precedence.
+//
+// Deprecated: the rate limit leaks into every limiter of the process. Use Limiter.RegisterAPI
+// to register it on the limiter it belongs to.
 func RegisterAPI(path string, method string, max int64, duration time.Duration) {
-	settings = append(settings, config.RateLimit{
+	RegisterAPIWithAlgorithm(path, method, max, duration, 0)
+}
+
+// RegisterAPIWithAlgorithm is RegisterAPI counting the requests with algorithm.
+//
+// Deprecated: use Limiter.RegisterAPIWithAlgorithm.
+func RegisterAPIWithAlgorithm(path string, method string, max int64, duration time.Duration, algorithm store.Algorithm) {
+	deprecatedOnce.Do(func() {
+		log.Println("tollbooth.RegisterAPI is deprecated, its rate limits apply to every limiter: use Limiter.RegisterAPI")
+	})
+
+	err := defaultRules.Add(config.RateLimit{
 		Key: config.LimitKey{
 			Path:   path,
 			Method: method,
 		},
 		Val: config.LimitValue{
-			Max: max,
-			TTL: duration,
+			Max:       max,
+			TTL:       duration,
+			Algorithm: algorithm,
 		},
 	})
-
-	config.By(func(l1, l2 *config.RateLimit) bool {
-		return len(l1.Key.Path) > len(l2.Key.Path)
-	}).Sort(settings)
+	if err != nil {
+		log.Println("fail to register rate limit: ", err)
+	}
 }
 
-// Reset resets the rate limit settings.
+// Reset resets the rate limit settings registered with RegisterAPI.
+//
+// Deprecated: rate limits registered with Limiter.RegisterAPI don't need to be reset.
 func Reset() {
-	settings = make([]config.RateLimit, 0)
-}
-
-func matchLimit(r *http.Request) *config.LimitValue {
-	path := r.URL.Path
-	method := r.Method
-	for i, ratelimit := range settings {
-		if ratelimit.Key.Method == method {
-			matched, _ := regexp.MatchString(ratelimit.Key.Path, path)
-			if matched {
-				return &settings[i].Val
-			}
-		}
+	defaultRules.Replace(nil)
+}
+
+// matchLimit returns the rate limit of the limiter applying to r, or else the one registered with
+// the deprecated RegisterAPI, which logs that its rate limits apply to every limiter.
+func matchLimit(limiter *config.Limiter, r *http.Request) *config.RateLimit {
+	if rule := limiter.Rules.Match(r); rule != nil {
+		return rule
 	}
-	return nil
+	return defaultRules.Match(r)
 }
 
 // LimitFuncHandler is a middleware that performs rate-limiting given request handler function.
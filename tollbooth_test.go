@@ -1,15 +1,18 @@
 package tollbooth
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	rate "github.com/aw16com/rate/redis"
 	"github.com/aw16com/tollbooth/config"
+	"github.com/aw16com/tollbooth/store"
 )
 
 func setup() {
@@ -518,3 +521,531 @@ func TestLimitHandlerAndSetRegexpAPIRateLimit(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
 	}
 }
+
+func TestLimitByRequestWithResult(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+
+	Reset()
+	RegisterAPI("/results", "GET", 3, time.Minute)
+	defer Reset()
+
+	request, err := http.NewRequest("GET", "/results", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+
+	result, httpError := LimitByRequestWithResult(limiter, request)
+	if httpError != nil {
+		t.Fatalf("First request should not be limited. Error: %v", httpError)
+	}
+	if result.Rule == nil || result.Rule.Key.Path != "/results" {
+		t.Errorf("Result should carry the matched rule. Rule: %+v", result.Rule)
+	}
+	if result.Limit.Max != 3 || result.Remaining != 2 {
+		t.Errorf("Result should describe the bucket of the rule. Result: %+v", result)
+	}
+
+	LimitByRequest(limiter, request)
+	LimitByRequest(limiter, request)
+	result, httpError = LimitByRequestWithResult(limiter, request)
+	if httpError == nil || result.Allowed {
+		t.Errorf("Fourth request should be limited. Result: %+v", result)
+	}
+	if result.RetryAfter <= 0 {
+		t.Errorf("Denied result should tell when to retry. RetryAfter: %v", result.RetryAfter)
+	}
+}
+
+func TestLimitHandlerHeaders(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	limiter.HeaderStyle = config.LegacyHeaders | config.XRateLimitHeaders | config.IETFHeaders
+
+	Reset()
+	RegisterAPI("/headers", "GET", 2, time.Minute)
+	defer Reset()
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`hello world`))
+	}))
+
+	req, err := http.NewRequest("GET", "/headers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	expected := map[string]string{
+		"X-Rate-Limit-Limit":    "2",
+		"X-Rate-Limit-Duration": "1m0s",
+		"X-RateLimit-Limit":     "2",
+		"X-RateLimit-Remaining": "1",
+		"RateLimit-Policy":      `"default";q=2;w=120`,
+		"RateLimit":             `"default";r=1;t=60`,
+		"Retry-After":           "",
+	}
+	for name, value := range expected {
+		if got := rr.Header().Get(name); got != value {
+			t.Errorf("Header %v is incorrect. Value: %v, expected: %v", name, got, value)
+		}
+	}
+	if reset, _ := strconv.ParseInt(rr.Header().Get("X-RateLimit-Reset"), 10, 64); reset <= time.Now().Unix() {
+		t.Errorf("X-RateLimit-Reset should be in the future. Value: %v", reset)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining should be 0 once limited. Value: %v", got)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After should tell when the next token is refilled. Value: %v", got)
+	}
+}
+
+func TestLimitHandlerSlidingWindowHeaders(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	limiter.HeaderStyle = config.IETFHeaders
+
+	Reset()
+	RegisterAPIWithAlgorithm("/sliding", "GET", 2, time.Minute, store.SlidingWindowLog)
+	defer Reset()
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`hello world`))
+	}))
+
+	req, err := http.NewRequest("GET", "/sliding", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c9")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if policy := rr.Header().Get("RateLimit-Policy"); policy != `"default";q=2;w=60` {
+		t.Errorf("Policy window of a sliding window should be its TTL. Value: %v", policy)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("Third request should wait for the first one to leave the window. Status: %v, Retry-After: %v", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestLimitHandlerMultipleLimits(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	limiter.Rules.Add(config.RateLimit{
+		Key:    config.LimitKey{Path: "/multiple", Method: "GET", Match: config.MatchExact},
+		Val:    config.LimitValue{Max: 10, TTL: time.Second},
+		Limits: []config.LimitValue{{Max: 2, TTL: time.Hour}},
+	})
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`hello world`))
+	}))
+
+	req, err := http.NewRequest("GET", "/multiple", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8ca")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get("X-RateLimit-Limit") != "2" || rr.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Errorf("Headers should report the most restrictive limit. Headers: %v", rr.Header())
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("X-Rate-Limit-Duration") != "1h0m0s" {
+		t.Errorf("Third request should be rejected by the hourly limit. Status: %v, Headers: %v", rr.Code, rr.Header())
+	}
+}
+
+func TestLimitHandlerCost(t *testing.T) {
+	limiter := NewLimiter(5, time.Minute, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	limiter.CostFunc = func(r *http.Request) int64 {
+		if r.URL.Path == "/export" {
+			return 3
+		}
+		return 0
+	}
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`hello world`))
+	}))
+
+	req, err := http.NewRequest("GET", "/export", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8cb")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("Export should take 3 tokens. Remaining: %v", rr.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Second export should be rejected. Status: %v", rr.Code)
+	}
+}
+
+func TestLimitByKeysWithCost(t *testing.T) {
+	limiter := NewLimiter(5, time.Minute, nil)
+	defer limiter.Close()
+	keys := []string{"127.0.0.1", "/bulk"}
+
+	if result, httpError := LimitByKeysWithCost(limiter, keys, nil, 5); httpError != nil || result.Remaining != 0 {
+		t.Errorf("Bulk request should take every token. Result: %+v", result)
+	}
+	if _, httpError := LimitByKeysWithCost(limiter, keys, nil, 1); httpError == nil {
+		t.Error("Request should be rejected once the bucket is empty.")
+	}
+}
+
+// contextStore is a memory store recording the context of the last take.
+type contextStore struct {
+	*store.Memory
+	ctx context.Context
+}
+
+func (s *contextStore) Take(ctx context.Context, key string, limit store.Limit, n int64) (store.State, error) {
+	s.ctx = ctx
+	return s.Memory.Take(ctx, key, limit, n)
+}
+
+type contextKey string
+
+func TestLimitByKeysContext(t *testing.T) {
+	s := &contextStore{Memory: store.NewMemory()}
+	limiter := NewLimiterWithStore(1, time.Minute, s)
+	defer limiter.Close()
+	ctx := context.WithValue(context.Background(), contextKey("request"), "TestLimitByKeysContext")
+
+	if httpError := LimitByKeysContext(ctx, limiter, []string{"127.0.0.1", "/"}, nil); httpError != nil {
+		t.Errorf("First request should be allowed. Error: %v", httpError)
+	}
+	if s.ctx.Value(contextKey("request")) != "TestLimitByKeysContext" {
+		t.Error("Store should be called with the context of the decision.")
+	}
+	if httpError := LimitByKeysContext(ctx, limiter, []string{"127.0.0.1", "/"}, nil); httpError == nil {
+		t.Error("Second request should be rejected.")
+	}
+}
+
+func TestLimitHandlerContext(t *testing.T) {
+	s := &contextStore{Memory: store.NewMemory()}
+	limiter := NewLimiterWithStore(1, time.Minute, s)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8ce")
+	req = req.WithContext(context.WithValue(req.Context(), contextKey("request"), "TestLimitHandlerContext"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if s.ctx == nil || s.ctx.Value(contextKey("request")) != "TestLimitHandlerContext" {
+		t.Error("Store should be called with the context of the request.")
+	}
+}
+
+func TestLimitHandlerKeyFunc(t *testing.T) {
+	limiter := NewLimiter(1, time.Minute, nil)
+	defer limiter.Close()
+	limiter.KeyFunc = config.Keys(config.Header("X-API-Key"))
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(ip string, apiKey string) int {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = ip + ":1234"
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if status := serve("10.0.0.1", "k1"); status != http.StatusOK {
+		t.Errorf("First request of the API key should be allowed. Status: %v", status)
+	}
+	if status := serve("10.0.0.2", "k1"); status != http.StatusTooManyRequests {
+		t.Errorf("Requests of an API key should share a bucket across IPs. Status: %v", status)
+	}
+	if status := serve("10.0.0.1", ""); status != http.StatusOK {
+		t.Errorf("Requests without key should not be limited. Status: %v", status)
+	}
+}
+
+func TestLimitHandlerTiers(t *testing.T) {
+	limiter := NewLimiter(1, time.Minute, nil)
+	defer limiter.Close()
+	limiter.KeyFunc = config.Keys(config.Claim(nil, "sub"))
+	limiter.LimitFunc = (&config.Tiers{
+		Claim:  "plan",
+		Limits: map[string]config.LimitValue{"pro": {Max: 2, TTL: time.Minute}},
+	}).Limit
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(sub string, plan string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Claims verified by an authentication middleware.
+		req = req.WithContext(config.WithClaims(req.Context(), config.Claims{"sub": sub, "plan": plan}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("u1", "free"); rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Errorf("Requests of the free plan should be limited by the limiter. Status: %v, Limit: %v", rr.Code, rr.Header().Get("X-RateLimit-Limit"))
+	}
+	if rr := serve("u1", "free"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Second request of the free plan should be rejected. Status: %v", rr.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if rr := serve("u2", "pro"); rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Errorf("Requests of the pro plan should be limited by their tier. Status: %v, Limit: %v", rr.Code, rr.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+	if rr := serve("u2", "pro"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Third request of the pro plan should be rejected. Status: %v", rr.Code)
+	}
+}
+
+func TestLimitHandlerMaxInFlight(t *testing.T) {
+	// Two requests per minute, the rejected one must not take the token of the third one.
+	limiter := NewLimiter(2, time.Minute, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	limiter.MaxInFlight = 1
+	limiter.HeaderStyle = config.LegacyHeaders | config.IETFHeaders
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-finish
+		w.Write([]byte(`hello world`))
+	}))
+
+	req, err := http.NewRequest("GET", "/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8cc")
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		done <- rr.Code
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Request should be rejected while another one is in flight. Status: %v", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" || rr.Header().Get("X-Rate-Limit-Limit") != "1" {
+		t.Errorf("Headers should match the in-flight rejection. Headers: %v", rr.Header())
+	}
+	if rr.Header().Get("X-Rate-Limit-Duration") != "" || rr.Header().Get("RateLimit-Policy") != "" {
+		t.Errorf("No window should be reported on the in-flight rejection. Headers: %v", rr.Header())
+	}
+
+	close(finish)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("In-flight request should succeed. Status: %v", status)
+	}
+
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Request should be handled once the slot is released. Status: %v", rr.Code)
+	}
+}
+
+func TestWaitHandler(t *testing.T) {
+	limiter := NewLimiter(1, 50*time.Millisecond, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	limiter.MaxWait = time.Second
+
+	handler := WaitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`hello world`))
+	}))
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8cd")
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Request %d should wait for its token rather than be rejected. Status: %v", i, rr.Code)
+		}
+	}
+
+	limiter.MaxWait = 0
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Request should be rejected at once without MaxWait. Status: %v", rr.Code)
+	}
+}
+
+func TestLimitHandlerWithoutHeaders(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	limiter.HeaderStyle = 0
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if len(rr.Header()) != 0 {
+		t.Errorf("No header should be set. Headers: %v", rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After should always be set on rejections. Value: %v", got)
+	}
+}
+
+func TestLimitHandlerRenderer(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+	req.Header.Set("Accept", "application/problem+json")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Rejection should be rendered as requested by Accept. Content-Type: %v", got)
+	}
+	if !strings.Contains(rr.Body.String(), `"retry_after":1`) {
+		t.Errorf("Rejection should tell when to retry. Body: %v", rr.Body.String())
+	}
+}
+
+func TestLimitHandlerOnLimitReached(t *testing.T) {
+	limiter := NewLimiter(1, time.Second, nil)
+	defer limiter.Close()
+	limiter.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+
+	var rejected *config.Result
+	limiter.OnLimitReached = func(w http.ResponseWriter, r *http.Request, result *config.Result) {
+		rejected = result
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`<h1>Slow down</h1>`))
+	}
+
+	handler := LimitHandler(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if rejected != nil {
+		t.Error("OnLimitReached should not be called for allowed requests.")
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rejected == nil || rejected.Allowed {
+		t.Fatalf("OnLimitReached should be called with the denied result. Result: %+v", rejected)
+	}
+	if rr.Code != http.StatusServiceUnavailable || rr.Body.String() != `<h1>Slow down</h1>` {
+		t.Errorf("OnLimitReached should replace the response. Code: %v, Body: %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestLimitHandlerWithLimiterRules(t *testing.T) {
+	strict := NewLimiter(1, time.Second, nil)
+	defer strict.Close()
+	strict.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	strict.RegisterAPI("/search", "GET", 1, time.Minute)
+
+	lenient := NewLimiter(1, time.Second, nil)
+	defer lenient.Close()
+	lenient.IPLookups = []string{"X-Real-IP", "RemoteAddr", "X-Forwarded-For"}
+	lenient.RegisterAPI("/search", "GET", 3, time.Minute)
+
+	req, err := http.NewRequest("GET", "/search", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Real-IP", "2601:7:1c82:4097:59a0:a80b:2841:b8c8")
+
+	for _, limiter := range []*config.Limiter{strict, lenient} {
+		result, _ := LimitByRequestWithResult(limiter, req)
+		if result.Rule == nil || result.Limit.Max != result.Rule.Val.Max {
+			t.Errorf("The rule of the limiter should apply. Result: %+v", result)
+		}
+	}
+	if _, httpError := LimitByRequestWithResult(strict, req); httpError == nil {
+		t.Error("Second request should be limited by the strict limiter.")
+	}
+	if _, httpError := LimitByRequestWithResult(lenient, req); httpError != nil {
+		t.Error("Second request should not be limited by the lenient limiter.")
+	}
+}